@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Twixes/backname/internal/server"
+)
+
+func runCheckConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	flags.Parse(args)
+
+	// Invalid configuration makes this exit with an explanation
+	shutdownTimeoutFromEnv()
+	httpListenFromEnv()
+	handler := new(server.DNSHandler)
+	handler.InitFromEnv()
+	server.ListenersFromEnv()
+	// Without opening the stores for writing, as a running server may be using them
+	if err := handler.CheckStores(); err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid: %v\n", err)
+		return 1
+	}
+
+	fmt.Println("Configuration is valid")
+	return 0
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Twixes/backname/internal/server"
+)
+
+func runDiagnose(args []string) int {
+	flags := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	parent := flags.String("parent", os.Getenv("DIAGNOSE_PARENT"), "parent nameserver of the zone, as host or host:port (default $DIAGNOSE_PARENT)")
+	port := flags.String("port", "53", "port to check the delegated nameservers on")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each reply")
+	flags.Parse(args)
+	if *parent == "" {
+		fmt.Fprintln(os.Stderr, "Usage: backname diagnose --parent <server> [--port <port>] [--timeout <duration>]")
+		return 2
+	}
+
+	handler := new(server.DNSHandler)
+	handler.InitFromEnv()
+
+	problems, err := handler.DiagnoseDelegation(*parent, *port, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Diagnosis failed: %v\n", err)
+		return 1
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Println("Delegation matches the configuration")
+	return 0
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Twixes/backname/pkg/backname"
+)
+
+func runEncode(args []string) int {
+	flags := flag.NewFlagSet("encode", flag.ExitOnError)
+	zone := flags.String("zone", os.Getenv("ZONE"), "zone of the backnames (default: $ZONE)")
+	prefix := flags.String("prefix", "", "labels to put in front of the address, e.g. foo for foo.127-0-0-1.<zone>")
+	secretRaw := flags.String("secret", os.Getenv("SIGNED_NAMES_SECRET"), "hex secret of at least 32 characters to sign the backname with (default: $SIGNED_NAMES_SECRET)")
+	lifetime := flags.Duration("expires", 0, "how long the signed backname resolves for, e.g. 24h (default: forever)")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 || *lifetime < 0 {
+		fmt.Fprintln(os.Stderr, "Usage: backname encode <ip> [--zone <zone>] [--prefix <labels>] [--secret <hex> [--expires <duration>]]")
+		return 2
+	}
+
+	ip := net.ParseIP(positional[0])
+	if ip == nil {
+		fmt.Fprintf(os.Stderr, "Invalid IP address: %s\n", positional[0])
+		return 1
+	}
+	if *secretRaw != "" {
+		secret, err := hex.DecodeString(*secretRaw)
+		if err != nil || len(secret) < backname.MinSecretLength {
+			fmt.Fprintf(os.Stderr, "Invalid secret: %s\n", *secretRaw)
+			return 1
+		}
+		var expires time.Time
+		if *lifetime > 0 {
+			expires = time.Now().Add(*lifetime)
+		}
+		name, err := backname.EncodeSigned(ip, *zone, secret, expires, *prefix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot encode %s: %v\n", ip, err)
+			return 1
+		}
+		fmt.Println(name)
+		return 0
+	}
+	names, err := backname.EncodeAll(ip, *zone, *prefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot encode %s: %v\n", ip, err)
+		return 1
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return 0
+}
+
+func runDecode(args []string) int {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	zone := flags.String("zone", os.Getenv("ZONE"), "zone of the backname (default: $ZONE)")
+	secretRaw := flags.String("secret", os.Getenv("SIGNED_NAMES_SECRET"), "hex secret that the backname must be signed with (default: $SIGNED_NAMES_SECRET)")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 || *zone == "" {
+		fmt.Fprintln(os.Stderr, "Usage: backname decode <name> --zone <zone> [--secret <hex>]")
+		return 2
+	}
+
+	var ip net.IP
+	if *secretRaw != "" {
+		secret, secretErr := hex.DecodeString(*secretRaw)
+		if secretErr != nil || len(secret) < backname.MinSecretLength {
+			fmt.Fprintf(os.Stderr, "Invalid secret: %s\n", *secretRaw)
+			return 1
+		}
+		ip, err = backname.DecodeSigned(positional[0], *zone, secret, time.Now())
+	} else {
+		ip, err = backname.Decode(positional[0], *zone)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot decode %s: %v\n", positional[0], err)
+		return 1
+	}
+	fmt.Println(ip)
+	return 0
+}
@@ -5,6 +5,7 @@ go 1.23.0
 require (
 	github.com/miekg/dns v1.1.56
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/sys v0.31.0
 )
 
 require (
@@ -12,7 +13,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/mod v0.12.0 // indirect
 	golang.org/x/net v0.38.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/tools v0.13.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// Record types that make up the minimal ANY response, in order of preference (a CNAME excludes all other data)
+var minimalANYTypes = []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeAAAA, dns.TypeTXT}
+
+// Record types that make up the full ANY response
+var fullANYTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeCAA, dns.TypeNS, dns.TypeSOA}
+
+// Resolve an ANY question as per RFC 8482: with a single representative RRset, or a synthesized HINFO record if
+// there is none, to avoid amplification. If allowed, TCP clients get all records of the name instead.
+func (h *DNSHandler) ResolveANY(question dns.Question, overTCP bool) ([]dns.RR, int) {
+	log.Printf("Resolving ANY records for %s\n", question.Name)
+
+	// A CNAME is the only record of its name, so it's the full answer too
+	cnameQuestion := question
+	cnameQuestion.Qtype = dns.TypeCNAME
+	records, code := h.resolveRRs(cnameQuestion)
+	if len(records) > 0 || (code != dns.RcodeSuccess && code != dns.RcodeNameError) {
+		return records, code
+	}
+
+	types := minimalANYTypes[1:]
+	full := overTCP && h.fullANYOverTCP
+	if full {
+		types = fullANYTypes
+	}
+
+	nameExists := code == dns.RcodeSuccess
+	for _, qtype := range types {
+		typeQuestion := question
+		typeQuestion.Qtype = qtype
+		typeRecords, typeCode := h.resolveRRs(typeQuestion)
+		if typeCode == dns.RcodeSuccess {
+			nameExists = true
+		}
+		records = append(records, typeRecords...)
+		if len(records) > 0 && !full {
+			break
+		}
+	}
+
+	if !nameExists {
+		return nil, dns.RcodeNameError
+	}
+	if len(records) == 0 && !full {
+		records = append(records, &dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  dns.ClassINET,
+				Ttl:    h.ttlFor(ttlClassNegative),
+			},
+			Cpu: "RFC8482",
+		})
+	}
+	return records, dns.RcodeSuccess
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvesMinimalANYForIPSubdomain(t *testing.T) {
+	handler := DNSHandler{
+		zone:           "example.com.",
+		nsA:            []net.IP{testNsA1},
+		fullANYOverTCP: true,
+	}
+
+	answers, rcode := handler.ResolveRRs(dns.Question{
+		Name:   "10-0-0-1.example.com.",
+		Qtype:  dns.TypeANY,
+		Qclass: dns.ClassINET,
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   "10-0-0-1.example.com.",
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			A: net.ParseIP("10.0.0.1"),
+		},
+	}, answers)
+}
+
+func TestResolvesHINFOForANYWithoutRecords(t *testing.T) {
+	handler := DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+
+	answers, rcode := handler.ResolveANY(dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeANY,
+		Qclass: dns.ClassINET,
+	}, true)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []dns.RR{
+		&dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   "example.com.",
+				Rrtype: dns.TypeHINFO,
+				Class:  dns.ClassINET,
+				Ttl:    negativeTTL,
+			},
+			Cpu: "RFC8482",
+		},
+	}, answers)
+}
+
+func TestResolvesCNAMEForANYAtWWW(t *testing.T) {
+	handler := DNSHandler{
+		zone:           "example.com.",
+		nsA:            []net.IP{testNsA1},
+		websiteA:       []net.IP{websiteA},
+		fullANYOverTCP: true,
+	}
+
+	answers, rcode := handler.ResolveANY(dns.Question{
+		Name:   "www.example.com.",
+		Qtype:  dns.TypeANY,
+		Qclass: dns.ClassINET,
+	}, true)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answers, 1)
+	assert.Equal(t, dns.TypeCNAME, answers[0].Header().Rrtype)
+}
+
+func TestResolvesFullANYOverTCPOnlyIfEnabled(t *testing.T) {
+	handler := DNSHandler{
+		zone:        "example.com.",
+		nsA:         []net.IP{testNsA1},
+		websiteA:    []net.IP{websiteA},
+		websiteAAAA: []net.IP{websiteAAAA},
+		rootTXT:     []string{"foo"},
+	}
+	question := dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeANY,
+		Qclass: dns.ClassINET,
+	}
+
+	answers, rcode := handler.ResolveANY(question, true)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answers, 1)
+	assert.Equal(t, dns.TypeA, answers[0].Header().Rrtype)
+
+	handler.fullANYOverTCP = true
+	answers_udp, rcode_udp := handler.ResolveANY(question, false)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode_udp)
+	assert.Len(t, answers_udp, 1)
+
+	answers_tcp, rcode_tcp := handler.ResolveANY(question, true)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode_tcp)
+	var types []uint16
+	for _, answer := range answers_tcp {
+		types = append(types, answer.Header().Rrtype)
+	}
+	assert.Equal(t, []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeNS, dns.TypeSOA}, types)
+}
+
+func TestDoesNotResolveANYForNonexistentName(t *testing.T) {
+	handler := DNSHandler{
+		zone:           "example.com.",
+		nsA:            []net.IP{testNsA1},
+		fullANYOverTCP: true,
+	}
+
+	answers, rcode := handler.ResolveANY(dns.Question{
+		Name:   "foo.example.com.",
+		Qtype:  dns.TypeANY,
+		Qclass: dns.ClassINET,
+	}, true)
+
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	assert.Equal(t, []dns.RR(nil), answers)
+}
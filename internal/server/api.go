@@ -0,0 +1,339 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Twixes/backname/pkg/backname"
+	"github.com/miekg/dns"
+)
+
+// How long aliases live when created without a TTL, e.g. through dyndns2, and at most
+const (
+	defaultAliasLifetime = 24 * time.Hour
+	maxAliasLifetime     = 30 * 24 * time.Hour
+)
+
+type apiToken struct {
+	token []byte
+	// Identifier stored as the owner of the token's aliases, so that the token itself isn't written anywhere
+	owner string
+	// How many aliases the token can have at once
+	quota int
+}
+
+type aliasRequest struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	TTL  string `json:"ttl"`
+}
+
+type aliasResponse struct {
+	Name    string    `json:"name"`
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires"`
+}
+
+// Errors of alias requests, besides invalid input
+var (
+	errAliasTaken = errors.New("name is taken")
+	errQuota      = errors.New("quota reached")
+)
+
+// Load the tokens allowed to use the HTTP API from the API_TOKENS environment variable, as comma-separated
+// <token>:<quota> pairs
+func apiTokensFromEnv() []apiToken {
+	apiTokensRaw := os.Getenv("API_TOKENS")
+	if apiTokensRaw == "" {
+		return nil
+	}
+	var tokens []apiToken
+	for i, apiTokenRaw := range strings.Split(apiTokensRaw, ",") {
+		token, quotaRaw, ok := strings.Cut(apiTokenRaw, ":")
+		quota, err := strconv.Atoi(quotaRaw)
+		if !ok || token == "" || err != nil || quota < 1 {
+			// The token is left out of the message on purpose
+			log.Fatalf("API_TOKENS environment variable is invalid: token %d must be <token>:<quota>", i+1)
+		}
+		owner := sha256.Sum256([]byte(token))
+		tokens = append(tokens, apiToken{token: []byte(token), owner: hex.EncodeToString(owner[:8]), quota: quota})
+	}
+	return tokens
+}
+
+// Token accepted as a bearer token, by the API or the admin API
+type bearerToken interface {
+	secret() []byte
+}
+
+func (t apiToken) secret() []byte { return t.token }
+
+// Find the token matching the given one, comparing in constant time with every token so that timing doesn't tell
+// which one matched
+func authenticate[T bearerToken](tokens []T, token string) (T, bool) {
+	var found T
+	ok := false
+	for _, candidate := range tokens {
+		if subtle.ConstantTimeCompare(candidate.secret(), []byte(token)) == 1 {
+			found, ok = candidate, true
+		}
+	}
+	return found, ok
+}
+
+// Record sets stored for the name, if it's an alias: a single label right below the zone
+func (h *DNSHandler) lookupAlias(name string) map[uint16][]dns.RR {
+	if h.apiTokens == nil {
+		return nil
+	}
+	name = dns.CanonicalName(name)
+	label, ok := strings.CutSuffix(name, "."+h.zone)
+	if !ok || strings.Contains(label, ".") {
+		return nil
+	}
+	return h.records.lookup(name)
+}
+
+// Check whether the alias already points at just the IP
+func (h *DNSHandler) isAliasOf(label string, ip netip.Addr) bool {
+	sets := h.lookupAlias(label + "." + h.zone)
+	if ip.Is4() {
+		return len(sets[dns.TypeA]) == 1 && sets[dns.TypeA][0].(*dns.A).A.Equal(ip.AsSlice())
+	}
+	return len(sets[dns.TypeAAAA]) == 1 && sets[dns.TypeAAAA][0].(*dns.AAAA).AAAA.Equal(ip.AsSlice())
+}
+
+// Check that an alias label is a hostname label clear of the static names and of IP-derived names
+func (h *DNSHandler) validateAliasLabel(label string) error {
+	if label == "" || len(label) > 63 || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" ||
+		label[0] == '-' || label[len(label)-1] == '-' {
+		return errors.New("name must be a single hostname label")
+	}
+	if slices.Contains(staticResponseNames[:], label+".") {
+		return errors.New("name is reserved")
+	}
+	if backname.ParseIPv4Subdomain(label) != nil || backname.ParseIPv6Subdomain(label) != nil {
+		return errors.New("name must not be an IP address")
+	}
+	return nil
+}
+
+// Point an alias at the IP for the lifetime, on behalf of the token, replacing its previous address. Updates are
+// serialized with DNS UPDATE, so that quotas can't be exceeded by concurrent requests
+func (h *DNSHandler) setAlias(token apiToken, label string, ip netip.Addr, lifetime time.Duration) (aliasResponse, error) {
+	name := label + "." + h.zone
+	expires := time.Now().Add(lifetime)
+
+	h.updateMu.Lock()
+	defer h.updateMu.Unlock()
+	owned := h.records.owned(token.owner)
+	if !slices.Contains(owned, name) {
+		if h.records.lookup(name) != nil {
+			return aliasResponse{}, errAliasTaken
+		}
+		if len(owned) >= token.quota {
+			return aliasResponse{}, errQuota
+		}
+	}
+
+	// The record's TTL doesn't outlive the alias
+	ttl := min(h.ttlFor(ttlClassIP), uint32(lifetime.Seconds()))
+	header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+	var record dns.RR
+	rrtype, otherType := dns.TypeA, dns.TypeAAAA
+	if ip.Is4() {
+		header.Rrtype = dns.TypeA
+		record = &dns.A{Hdr: header, A: ip.AsSlice()}
+	} else {
+		header.Rrtype = dns.TypeAAAA
+		record = &dns.AAAA{Hdr: header, AAAA: ip.AsSlice()}
+		rrtype, otherType = dns.TypeAAAA, dns.TypeA
+	}
+	changes := []recordChange{
+		{name: name, rrtype: rrtype, records: []dns.RR{record}, expires: expires, owner: token.owner},
+		{name: name, rrtype: otherType},
+	}
+	if err := h.records.update(changes); err != nil {
+		return aliasResponse{}, err
+	}
+	log.Printf("Pointed %s at %s until %s\n", name, ip, expires.Format(time.RFC3339))
+	return aliasResponse{Name: name, IP: ip.String(), Expires: expires.UTC().Truncate(time.Second)}, nil
+}
+
+// Delete an alias of the token, reporting whether it had one by that name
+func (h *DNSHandler) deleteAlias(token apiToken, label string) (bool, error) {
+	name := label + "." + h.zone
+	h.updateMu.Lock()
+	defer h.updateMu.Unlock()
+	if !slices.Contains(h.records.owned(token.owner), name) {
+		return false, nil
+	}
+	err := h.records.update([]recordChange{{name: name, rrtype: dns.TypeA}, {name: name, rrtype: dns.TypeAAAA}})
+	return err == nil, err
+}
+
+// Serve the HTTP API on the mux, if any API token is configured: POST /v1/names to create or update an alias,
+// GET /v1/names to list the token's aliases, DELETE /v1/names/{name} to delete one, and /nic/update for the dyndns2
+// protocol. With admin tokens, the blocklist is managed too: GET /v1/blocklist to list its entries, POST
+// /v1/blocklist to add one, DELETE /v1/blocklist/{ip} to remove one
+func (h *DNSHandler) RegisterAPI(mux *http.ServeMux) {
+	if h.apiTokens != nil {
+		mux.HandleFunc("POST /v1/names", withBearerToken(h.apiTokens, h.handleSetAlias))
+		mux.HandleFunc("GET /v1/names", withBearerToken(h.apiTokens, h.handleListAliases))
+		mux.HandleFunc("DELETE /v1/names/{name}", withBearerToken(h.apiTokens, h.handleDeleteAlias))
+		mux.HandleFunc("GET /nic/update", h.handleDynDNSUpdate)
+	}
+	if h.adminTokens != nil {
+		mux.HandleFunc("GET /v1/blocklist", withBearerToken(h.adminTokens, h.handleListBlocklist))
+		mux.HandleFunc("POST /v1/blocklist", withBearerToken(h.adminTokens, h.handleAddToBlocklist))
+		mux.HandleFunc("DELETE /v1/blocklist/{ip}", withBearerToken(h.adminTokens, h.handleRemoveFromBlocklist))
+	}
+}
+
+// Pass requests to the handler along with the token they authenticate with, rejecting those without a valid one
+func withBearerToken[T bearerToken](tokens []T, handle func(http.ResponseWriter, *http.Request, T)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token, authenticated := authenticate(tokens, bearer)
+		if !ok || !authenticated {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		handle(w, r, token)
+	}
+}
+
+func (h *DNSHandler) handleSetAlias(w http.ResponseWriter, r *http.Request, token apiToken) {
+	var request aliasRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "body must be JSON with name, ip and ttl")
+		return
+	}
+	label := strings.ToLower(request.Name)
+	if err := h.validateAliasLabel(label); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ip, err := netip.ParseAddr(request.IP)
+	if err != nil || ip.Zone() != "" {
+		writeAPIError(w, http.StatusBadRequest, "ip must be an IPv4 or IPv6 address")
+		return
+	}
+	lifetime := defaultAliasLifetime
+	if request.TTL != "" {
+		lifetime, err = time.ParseDuration(request.TTL)
+		if err != nil || lifetime < time.Second || lifetime > maxAliasLifetime {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("ttl must be a duration between 1s and %s", maxAliasLifetime))
+			return
+		}
+	}
+
+	alias, err := h.setAlias(token, label, ip.Unmap(), lifetime)
+	switch {
+	case errors.Is(err, errAliasTaken):
+		writeAPIError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errQuota):
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("quota of %d names reached", token.quota))
+	case err != nil:
+		log.Printf("Failed to store alias %s: %v\n", label, err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to store name")
+	default:
+		writeJSON(w, http.StatusOK, alias)
+	}
+}
+
+func (h *DNSHandler) handleListAliases(w http.ResponseWriter, r *http.Request, token apiToken) {
+	names := h.records.owned(token.owner)
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"names": names})
+}
+
+func (h *DNSHandler) handleDeleteAlias(w http.ResponseWriter, r *http.Request, token apiToken) {
+	deleted, err := h.deleteAlias(token, strings.ToLower(r.PathValue("name")))
+	switch {
+	case err != nil:
+		log.Printf("Failed to delete alias %s: %v\n", r.PathValue("name"), err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to delete name")
+	case !deleted:
+		writeAPIError(w, http.StatusNotFound, "no such name")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Update aliases as with the dyndns2 protocol used by routers: GET /nic/update?hostname=<fqdn>[,<fqdn>...]&myip=<ip>
+// with the token as the basic auth password, answering a status line per hostname
+func (h *DNSHandler) handleDynDNSUpdate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, password, _ := r.BasicAuth()
+	token, ok := authenticate(h.apiTokens, password)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="backname"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "badauth")
+		return
+	}
+
+	// Without myip, the address the request comes from is used
+	ipRaw := r.URL.Query().Get("myip")
+	if ipRaw == "" {
+		ipRaw, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	ip, err := netip.ParseAddr(ipRaw)
+	if err != nil || ip.Zone() != "" {
+		fmt.Fprintln(w, "dnserr")
+		return
+	}
+	ip = ip.Unmap()
+
+	for _, hostname := range strings.Split(r.URL.Query().Get("hostname"), ",") {
+		label, ok := strings.CutSuffix(dns.CanonicalName(hostname), "."+h.zone)
+		if !ok || h.validateAliasLabel(label) != nil {
+			fmt.Fprintln(w, "notfqdn")
+			continue
+		}
+		// The alias gets renewed all the same, so that routers updating periodically keep it alive
+		unchanged := h.isAliasOf(label, ip)
+		_, err := h.setAlias(token, label, ip, defaultAliasLifetime)
+		switch {
+		case errors.Is(err, errAliasTaken):
+			fmt.Fprintln(w, "!yours")
+		case errors.Is(err, errQuota):
+			// The closest dyndns2 has to a quota is the limit of hosts per account
+			fmt.Fprintln(w, "numhost")
+		case err != nil:
+			log.Printf("Failed to store alias %s: %v\n", label, err)
+			fmt.Fprintln(w, "911")
+		case unchanged:
+			fmt.Fprintln(w, "nochg", ip)
+		default:
+			fmt.Fprintln(w, "good", ip)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
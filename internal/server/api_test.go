@@ -0,0 +1,144 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAPIHandler() (*DNSHandler, *http.ServeMux) {
+	handler := newTestTransferHandler()
+	handler.apiTokens = []apiToken{
+		{token: []byte("ci-token"), owner: "ci", quota: 2},
+		{token: []byte("router-token"), owner: "router", quota: 1},
+	}
+	handler.records = newMemoryStore()
+	mux := http.NewServeMux()
+	handler.RegisterAPI(mux)
+	return handler, mux
+}
+
+func serveAPI(mux *http.ServeMux, method, target, token, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCreatesAliasesThroughAPI(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler, mux := newTestAPIHandler()
+
+	response := serveAPI(mux, "POST", "/v1/names", "ci-token", `{"name":"Demo","ip":"10.0.0.7","ttl":"1h"}`)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"name":"demo.example.com.","ip":"10.0.0.7"`)
+	records, rcode := handler.ResolveRRs(dns.Question{Name: "demo.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []string{"demo.example.com.\t3600\tIN\tA\t10.0.0.7"}, recordStrings(records))
+	expires := handler.records.(*memoryStore).names["demo.example.com."][dns.TypeA].expires
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expires, time.Minute)
+
+	// Pointing the alias at an IPv6 address replaces the IPv4 one
+	response = serveAPI(mux, "POST", "/v1/names", "ci-token", `{"name":"demo","ip":"2001:db8::7"}`)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	records, _ = handler.ResolveRRs(dns.Question{Name: "demo.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Empty(t, records)
+	records, _ = handler.ResolveRRs(dns.Question{Name: "demo.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	assert.Len(t, records, 1)
+
+	response = serveAPI(mux, "GET", "/v1/names", "ci-token", "")
+
+	assert.Equal(t, `{"names":["demo.example.com."]}`+"\n", response.Body.String())
+
+	response = serveAPI(mux, "DELETE", "/v1/names/demo", "ci-token", "")
+
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	_, rcode = handler.ResolveRRs(dns.Question{Name: "demo.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeNameError, rcode)
+}
+
+func TestEnforcesAPITokensAndQuotas(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	_, mux := newTestAPIHandler()
+
+	assert.Equal(t, http.StatusUnauthorized, serveAPI(mux, "POST", "/v1/names", "", `{"name":"demo","ip":"10.0.0.7"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAPI(mux, "POST", "/v1/names", "wrong-token", `{"name":"demo","ip":"10.0.0.7"}`).Code)
+
+	assert.Equal(t, http.StatusOK, serveAPI(mux, "POST", "/v1/names", "router-token", `{"name":"home","ip":"10.0.0.7"}`).Code)
+	assert.Equal(t, http.StatusForbidden, serveAPI(mux, "POST", "/v1/names", "router-token", `{"name":"cabin","ip":"10.0.0.8"}`).Code)
+	assert.Equal(t, http.StatusOK, serveAPI(mux, "POST", "/v1/names", "router-token", `{"name":"home","ip":"10.0.0.8"}`).Code)
+
+	// Names belong to the token that created them
+	assert.Equal(t, http.StatusConflict, serveAPI(mux, "POST", "/v1/names", "ci-token", `{"name":"home","ip":"10.0.0.9"}`).Code)
+	assert.Equal(t, http.StatusNotFound, serveAPI(mux, "DELETE", "/v1/names/home", "ci-token", "").Code)
+}
+
+func TestValidatesAliases(t *testing.T) {
+	_, mux := newTestAPIHandler()
+
+	for _, body := range []string{
+		`{"name":"www","ip":"10.0.0.7"}`,
+		`{"name":"10-0-0-7","ip":"10.0.0.7"}`,
+		`{"name":"demo.staging","ip":"10.0.0.7"}`,
+		`{"name":"-demo","ip":"10.0.0.7"}`,
+		`{"name":"demo","ip":"10.0.0"}`,
+		`{"name":"demo","ip":"10.0.0.7","ttl":"1000h"}`,
+		`{"name":"demo","ip":"10.0.0.7","ttl":"tomorrow"}`,
+		`not json`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, serveAPI(mux, "POST", "/v1/names", "ci-token", body).Code, body)
+	}
+}
+
+func TestExpiresAliases(t *testing.T) {
+	handler, _ := newTestAPIHandler()
+	handler.records.update([]recordChange{{
+		name:    "demo.example.com.",
+		rrtype:  dns.TypeA,
+		records: []dns.RR{mustRR(t, "demo.example.com. 60 IN A 10.0.0.7")},
+		expires: time.Now().Add(-time.Second),
+	}})
+
+	_, rcode := handler.ResolveRRs(dns.Question{Name: "demo.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	assert.Equal(t, dns.RcodeNameError, rcode)
+}
+
+func TestUpdatesAliasesWithDynDNS2(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler, mux := newTestAPIHandler()
+	update := func(password, query string) string {
+		request := httptest.NewRequest("GET", "/nic/update?"+query, nil)
+		request.RemoteAddr = "198.51.100.7:41234"
+		request.SetBasicAuth("router", password)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder.Body.String()
+	}
+
+	assert.Equal(t, "good 10.0.0.7\n", update("router-token", "hostname=home.example.com&myip=10.0.0.7"))
+	assert.Equal(t, "nochg 10.0.0.7\n", update("router-token", "hostname=home.example.com&myip=10.0.0.7"))
+	assert.Equal(t, "good 198.51.100.7\n", update("router-token", "hostname=home.example.com"))
+	assert.Equal(t, "numhost\n", update("router-token", "hostname=cabin.example.com"))
+	assert.Equal(t, "!yours\nnotfqdn\n", update("ci-token", "hostname=home.example.com,home.example.net"))
+	assert.Equal(t, "badauth\n", update("wrong-token", "hostname=home.example.com"))
+
+	records, _ := handler.ResolveRRs(dns.Question{Name: "home.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, []string{"home.example.com.\t86400\tIN\tA\t198.51.100.7"}, recordStrings(records))
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Longest lifetime of a blocklist entry added with a TTL, entries added without one lasting until removed
+const maxBlocklistLifetime = 365 * 24 * time.Hour
+
+// Actions recorded in the blocklist audit log
+const (
+	blocklistActionAdd    = "add"
+	blocklistActionRemove = "remove"
+	blocklistActionExpire = "expire"
+)
+
+type blocklistEntry struct {
+	ip      netip.Addr
+	reason  string
+	addedBy string
+	created time.Time
+	// When the entry stops applying and gets pruned, never if zero
+	expires time.Time
+}
+
+func (e blocklistEntry) isExpired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// Addresses that don't get a backname, changed at runtime through the admin API, with every change recorded in an
+// append-only audit log that gets replayed on startup
+type blocklist struct {
+	// Entries by address, read without locking when resolving, replaced as a whole on every change
+	entries atomic.Pointer[map[netip.Addr]blocklistEntry]
+	// Serializes changes along with their audit records
+	mu        sync.Mutex
+	audit     *jsonLog
+	auditPath string
+}
+
+// Line of the audit log
+type blocklistAuditRecord struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	IP     string    `json:"ip"`
+	// Admin who made the change, empty for expiry
+	By      string     `json:"by,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type blocklistEntryResponse struct {
+	IP      string     `json:"ip"`
+	Reason  string     `json:"reason,omitempty"`
+	AddedBy string     `json:"added_by"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type blocklistRequest struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+	TTL    string `json:"ttl"`
+}
+
+type adminToken struct {
+	// Name of the admin, recorded as who made the changes
+	name  string
+	token []byte
+}
+
+func (t adminToken) secret() []byte { return t.token }
+
+func newBlocklist(entries []blocklistEntry) *blocklist {
+	index := make(map[netip.Addr]blocklistEntry, len(entries))
+	for _, entry := range entries {
+		index[entry.ip] = entry
+	}
+	b := new(blocklist)
+	b.entries.Store(&index)
+	return b
+}
+
+// Load the blocklist from the BLOCKLIST environment variable, as comma-separated IP addresses, along with the path of
+// the audit log from the BLOCKLIST_AUDIT_LOG environment variable, whose changes apply on top once it's opened
+func blocklistFromEnv() *blocklist {
+	var entries []blocklistEntry
+	if blocklistIPsRaw := os.Getenv("BLOCKLIST"); blocklistIPsRaw != "" {
+		now := time.Now()
+		for _, blocklistIPRaw := range strings.Split(blocklistIPsRaw, ",") {
+			blocklistIP, err := netip.ParseAddr(blocklistIPRaw)
+			if err != nil || blocklistIP.Zone() != "" {
+				log.Fatalf("BLOCKLIST environment variable is invalid: %s", blocklistIPRaw)
+			}
+			entries = append(entries, blocklistEntry{ip: blocklistIP.Unmap(), addedBy: "BLOCKLIST", created: now})
+		}
+	}
+	b := newBlocklist(entries)
+	// The audit log itself is only opened for serving, as opening it records the expiry of entries
+	b.auditPath = os.Getenv("BLOCKLIST_AUDIT_LOG")
+	return b
+}
+
+// Load the tokens allowed to use the admin API from the ADMIN_TOKENS environment variable, as comma-separated
+// <name>:<token> pairs
+func adminTokensFromEnv() []adminToken {
+	adminTokensRaw := os.Getenv("ADMIN_TOKENS")
+	if adminTokensRaw == "" {
+		return nil
+	}
+	var tokens []adminToken
+	for i, adminTokenRaw := range strings.Split(adminTokensRaw, ",") {
+		name, token, ok := strings.Cut(adminTokenRaw, ":")
+		if !ok || name == "" || token == "" {
+			// The token is left out of the message on purpose
+			log.Fatalf("ADMIN_TOKENS environment variable is invalid: token %d must be <name>:<token>", i+1)
+		}
+		tokens = append(tokens, adminToken{name: name, token: []byte(token)})
+	}
+	if os.Getenv("BLOCKLIST_AUDIT_LOG") == "" {
+		log.Fatalf("BLOCKLIST_AUDIT_LOG environment variable is invalid: it must be set along with ADMIN_TOKENS")
+	}
+	return tokens
+}
+
+// Apply the changes recorded in the audit log at the path, which then gets appended to. Entries that expired
+// meanwhile are pruned
+func (b *blocklist) openAuditLog(path string) error {
+	entries := maps.Clone(*b.entries.Load())
+	audit, err := openJSONLog(path, func(record blocklistAuditRecord) error {
+		return applyAuditRecord(entries, record)
+	})
+	if err != nil {
+		return err
+	}
+	b.audit = audit
+	b.auditPath = path
+	b.entries.Store(&entries)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prune(time.Now())
+}
+
+// Check that the audit log at the path can be replayed, without writing to it, so that a server using it isn't
+// disturbed
+func checkAuditLog(path string) error {
+	entries := make(map[netip.Addr]blocklistEntry)
+	return checkJSONLog(path, func(record blocklistAuditRecord) error {
+		return applyAuditRecord(entries, record)
+	})
+}
+
+// Apply a change recorded in the audit log to the entries
+func applyAuditRecord(entries map[netip.Addr]blocklistEntry, record blocklistAuditRecord) error {
+	ip, err := netip.ParseAddr(record.IP)
+	if err != nil {
+		return err
+	}
+	delete(entries, ip)
+	if record.Action == blocklistActionAdd {
+		entry := blocklistEntry{ip: ip, reason: record.Reason, addedBy: record.By, created: record.Time}
+		if record.Expires != nil {
+			entry.expires = *record.Expires
+		}
+		entries[ip] = entry
+	}
+	return nil
+}
+
+// Entry blocking the address at the given time, if any
+func (b *blocklist) lookup(ip netip.Addr, now time.Time) (blocklistEntry, bool) {
+	entry, ok := (*b.entries.Load())[ip]
+	if !ok || entry.isExpired(now) {
+		return blocklistEntry{}, false
+	}
+	return entry, true
+}
+
+// Drop the entries that have expired, recording their expiry
+func (b *blocklist) pruneExpired() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prune(time.Now())
+}
+
+// Entries that haven't expired, by address, pruning those that have
+func (b *blocklist) list() ([]blocklistEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.prune(time.Now())
+	entries := slices.Collect(maps.Values(*b.entries.Load()))
+	slices.SortFunc(entries, func(a, b blocklistEntry) int { return a.ip.Compare(b.ip) })
+	return entries, err
+}
+
+// Add the entry, replacing any other of its address
+func (b *blocklist) add(entry blocklistEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.prune(entry.created); err != nil {
+		return err
+	}
+	if err := b.record(blocklistActionAdd, entry, entry.addedBy, entry.created); err != nil {
+		return err
+	}
+	entries := maps.Clone(*b.entries.Load())
+	entries[entry.ip] = entry
+	b.entries.Store(&entries)
+	return nil
+}
+
+// Remove the entry of the address on behalf of the admin, reporting whether there was one
+func (b *blocklist) remove(ip netip.Addr, by string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if err := b.prune(now); err != nil {
+		return false, err
+	}
+	entry, ok := (*b.entries.Load())[ip]
+	if !ok {
+		return false, nil
+	}
+	if err := b.record(blocklistActionRemove, entry, by, now); err != nil {
+		return false, err
+	}
+	entries := maps.Clone(*b.entries.Load())
+	delete(entries, ip)
+	b.entries.Store(&entries)
+	return true, nil
+}
+
+// Drop the entries that have expired, recording their expiry. The lock must be held
+func (b *blocklist) prune(now time.Time) error {
+	entries := *b.entries.Load()
+	var live map[netip.Addr]blocklistEntry
+	for ip, entry := range entries {
+		if !entry.isExpired(now) {
+			continue
+		}
+		if live == nil {
+			live = maps.Clone(entries)
+		}
+		if err := b.record(blocklistActionExpire, entry, "", now); err != nil {
+			// Entries expired before the failure stay pruned, as their expiry is recorded
+			b.entries.Store(&live)
+			return err
+		}
+		delete(live, ip)
+	}
+	if live != nil {
+		b.entries.Store(&live)
+	}
+	return nil
+}
+
+// Append a change to the audit log. The lock must be held
+func (b *blocklist) record(action string, entry blocklistEntry, by string, now time.Time) error {
+	log.Printf("Blocklist %s of %s by %q: %s\n", action, entry.ip, by, entry.reason)
+	if b.audit == nil {
+		return nil
+	}
+	record := blocklistAuditRecord{Time: now.UTC(), Action: action, IP: entry.ip.String(), By: by, Reason: entry.reason}
+	if action == blocklistActionAdd && !entry.expires.IsZero() {
+		expires := entry.expires.UTC()
+		record.Expires = &expires
+	}
+	return b.audit.append(record)
+}
+
+func (b *blocklist) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.audit == nil {
+		return nil
+	}
+	// Changes after closing are only logged, e.g. by pruning that's still running during shutdown
+	audit := b.audit
+	b.audit = nil
+	return audit.close()
+}
+
+func (e blocklistEntry) response() blocklistEntryResponse {
+	response := blocklistEntryResponse{IP: e.ip.String(), Reason: e.reason, AddedBy: e.addedBy, Created: e.created.UTC()}
+	if !e.expires.IsZero() {
+		expires := e.expires.UTC()
+		response.Expires = &expires
+	}
+	return response
+}
+
+func (h *DNSHandler) handleListBlocklist(w http.ResponseWriter, r *http.Request, admin adminToken) {
+	entries, err := h.blocklist.list()
+	if err != nil {
+		log.Printf("Failed to prune the blocklist: %v\n", err)
+	}
+	responses := make([]blocklistEntryResponse, 0, len(entries))
+	for _, entry := range entries {
+		responses = append(responses, entry.response())
+	}
+	writeJSON(w, http.StatusOK, map[string][]blocklistEntryResponse{"entries": responses})
+}
+
+func (h *DNSHandler) handleAddToBlocklist(w http.ResponseWriter, r *http.Request, admin adminToken) {
+	var request blocklistRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "body must be JSON with ip, reason and ttl")
+		return
+	}
+	ip, err := netip.ParseAddr(request.IP)
+	if err != nil || ip.Zone() != "" {
+		writeAPIError(w, http.StatusBadRequest, "ip must be an IPv4 or IPv6 address")
+		return
+	}
+	entry := blocklistEntry{ip: ip.Unmap(), reason: request.Reason, addedBy: admin.name, created: time.Now()}
+	if request.TTL != "" {
+		lifetime, err := time.ParseDuration(request.TTL)
+		if err != nil || lifetime < time.Second || lifetime > maxBlocklistLifetime {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("ttl must be a duration between 1s and %s", maxBlocklistLifetime))
+			return
+		}
+		entry.expires = entry.created.Add(lifetime)
+	}
+
+	if err := h.blocklist.add(entry); err != nil {
+		log.Printf("Failed to add %s to the blocklist: %v\n", ip, err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to record the change")
+		return
+	}
+	writeJSON(w, http.StatusOK, entry.response())
+}
+
+func (h *DNSHandler) handleRemoveFromBlocklist(w http.ResponseWriter, r *http.Request, admin adminToken) {
+	ip, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil || ip.Zone() != "" {
+		writeAPIError(w, http.StatusBadRequest, "ip must be an IPv4 or IPv6 address")
+		return
+	}
+	removed, err := h.blocklist.remove(ip.Unmap(), admin.name)
+	switch {
+	case err != nil:
+		log.Printf("Failed to remove %s from the blocklist: %v\n", ip, err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to record the change")
+	case !removed:
+		writeAPIError(w, http.StatusNotFound, "no such entry")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBlocklist(ips ...string) *blocklist {
+	var entries []blocklistEntry
+	for _, ip := range ips {
+		entries = append(entries, blocklistEntry{ip: netip.MustParseAddr(ip), addedBy: "BLOCKLIST"})
+	}
+	return newBlocklist(entries)
+}
+
+func openTestBlocklist(t *testing.T, path string, ips ...string) *blocklist {
+	b := newTestBlocklist(ips...)
+	if err := b.openAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.close() })
+	return b
+}
+
+func TestExpiresBlocklistEntries(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	b := newTestBlocklist("10.0.0.1")
+	now := time.Now()
+	b.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.2"), created: now.Add(-time.Hour), expires: now.Add(-time.Second)})
+	b.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.3"), created: now, expires: now.Add(time.Hour)})
+
+	_, blocked := b.lookup(netip.MustParseAddr("10.0.0.2"), now)
+
+	assert.False(t, blocked)
+
+	entries, err := b.list()
+
+	assert.NoError(t, err)
+	var ips []string
+	for _, entry := range entries {
+		ips = append(ips, entry.ip.String())
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, ips)
+}
+
+func TestListsBlocklistEntriesByAddress(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	b := newTestBlocklist("10.0.0.3", "2001:db8::1", "10.0.0.1")
+	b.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.2"), reason: "abuse", created: time.Now()})
+	b.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.2"), reason: "spam", created: time.Now()})
+
+	entries, err := b.list()
+	assert.NoError(t, err)
+	var ips []string
+	for _, entry := range entries {
+		ips = append(ips, entry.ip.String())
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "2001:db8::1"}, ips)
+	entry, ok := b.lookup(netip.MustParseAddr("10.0.0.2"), time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, "spam", entry.reason)
+	_, ok = b.lookup(netip.MustParseAddr("10.0.0.4"), time.Now())
+	assert.False(t, ok)
+}
+
+func TestReplaysBlocklistAuditLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	path := filepath.Join(t.TempDir(), "blocklist.log")
+	b := openTestBlocklist(t, path, "10.0.0.1", "10.0.0.2")
+	now := time.Now()
+	b.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.3"), reason: "phishing", addedBy: "alice", created: now})
+	b.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.4"), addedBy: "alice", created: now, expires: now.Add(time.Hour)})
+	b.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.5"), addedBy: "alice", created: now, expires: now.Add(time.Second)})
+	b.remove(netip.MustParseAddr("10.0.0.1"), "bob")
+	b.close()
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	file.WriteString(`{"time":"2024-01-01T00:00:00Z","action":"remove","ip":"10.0.0.2"`)
+	file.Close()
+
+	replayed := openTestBlocklist(t, path, "10.0.0.1", "10.0.0.2")
+
+	entry, blocked := replayed.lookup(netip.MustParseAddr("10.0.0.3"), now)
+	assert.True(t, blocked)
+	assert.Equal(t, "phishing", entry.reason)
+	assert.Equal(t, "alice", entry.addedBy)
+	assert.Equal(t, now.Unix(), entry.created.Unix())
+	entry, blocked = replayed.lookup(netip.MustParseAddr("10.0.0.4"), now)
+	assert.True(t, blocked)
+	assert.Equal(t, now.Add(time.Hour).Unix(), entry.expires.Unix())
+	_, blocked = replayed.lookup(netip.MustParseAddr("10.0.0.1"), now)
+	assert.False(t, blocked)
+	// The torn removal never happened
+	_, blocked = replayed.lookup(netip.MustParseAddr("10.0.0.2"), now)
+	assert.True(t, blocked)
+
+	// Every change is kept, the torn one aside
+	audit, _ := os.ReadFile(path)
+	assert.Equal(t, 4, strings.Count(string(audit), "\n"))
+	assert.Contains(t, string(audit), `"action":"remove","ip":"10.0.0.1","by":"bob"`)
+}
+
+func TestManagesBlocklistThroughAdminAPI(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTransferHandler()
+	handler.blocklist = openTestBlocklist(t, filepath.Join(t.TempDir(), "blocklist.log"))
+	handler.adminTokens = []adminToken{{name: "alice", token: []byte("admin-token")}}
+	mux := http.NewServeMux()
+	handler.RegisterAPI(mux)
+	question := dns.Question{Name: "10-0-0-7.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	assert.Equal(t, http.StatusUnauthorized, serveAPI(mux, "POST", "/v1/blocklist", "", `{"ip":"10.0.0.7"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serveAPI(mux, "POST", "/v1/blocklist", "admin-token", `{"ip":"10.0.0"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serveAPI(mux, "POST", "/v1/blocklist", "admin-token", `{"ip":"10.0.0.7","ttl":"forever"}`).Code)
+
+	response := serveAPI(mux, "POST", "/v1/blocklist", "admin-token", `{"ip":"10.0.0.7","reason":"malware","ttl":"24h"}`)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"ip":"10.0.0.7","reason":"malware","added_by":"alice"`)
+	_, rcode := handler.ResolveRRs(question)
+	assert.Equal(t, dns.RcodeNameError, rcode)
+
+	response = serveAPI(mux, "GET", "/v1/blocklist", "admin-token", "")
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"expires":"`)
+
+	assert.Equal(t, http.StatusNoContent, serveAPI(mux, "DELETE", "/v1/blocklist/10.0.0.7", "admin-token", "").Code)
+	assert.Equal(t, http.StatusNotFound, serveAPI(mux, "DELETE", "/v1/blocklist/10.0.0.7", "admin-token", "").Code)
+	_, rcode = handler.ResolveRRs(question)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, `{"entries":[]}`+"\n", serveAPI(mux, "GET", "/v1/blocklist", "admin-token", "").Body.String())
+}
+
+func TestPrunesBlocklistPeriodically(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	path := filepath.Join(t.TempDir(), "blocklist.log")
+	handler := &DNSHandler{blocklist: openTestBlocklist(t, path)}
+	now := time.Now()
+	handler.blocklist.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.1"), created: now, expires: now.Add(50 * time.Millisecond)})
+	done := make(chan struct{})
+	go handler.PruneBlocklistEvery(10*time.Millisecond, done)
+	defer close(done)
+
+	assert.Eventually(t, func() bool {
+		return len(*handler.blocklist.entries.Load()) == 0
+	}, time.Second, 10*time.Millisecond)
+	audit, _ := os.ReadFile(path)
+	assert.Contains(t, string(audit), `"action":"expire","ip":"10.0.0.1"`)
+}
+
+func TestChecksAuditLogWithoutWritingToIt(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	path := filepath.Join(t.TempDir(), "blocklist.log")
+	b := openTestBlocklist(t, path)
+	now := time.Now()
+	b.add(blocklistEntry{ip: netip.MustParseAddr("10.0.0.1"), created: now.Add(-time.Hour), expires: now.Add(-time.Minute)})
+	b.close()
+	// Expired, and torn, but only the server may record either
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	file.WriteString(`{"time":"2024-01-01T00:00:00Z","action":"remove"`)
+	file.Close()
+	contents, _ := os.ReadFile(path)
+
+	assert.NoError(t, checkAuditLog(path))
+	checked, _ := os.ReadFile(path)
+	assert.Equal(t, contents, checked)
+
+	os.WriteFile(path, append([]byte("not json\n"), contents...), 0o600)
+
+	assert.ErrorContains(t, checkAuditLog(path), "corrupted")
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// A single CAA property, e.g. issue "letsencrypt.org" (RFC 8659)
+type caaProperty struct {
+	tag   string
+	value string
+}
+
+// Load CAA properties from the CAA_* environment variables
+func caaFromEnv() ([]caaProperty, bool) {
+	var properties []caaProperty
+	for _, tagAndVariable := range [][2]string{
+		{"issue", "CAA_ISSUE"},
+		{"issuewild", "CAA_ISSUEWILD"},
+		{"iodef", "CAA_IODEF"},
+	} {
+		tag, variable := tagAndVariable[0], tagAndVariable[1]
+		valuesRaw := os.Getenv(variable)
+		if valuesRaw == "" {
+			continue
+		}
+		for _, value := range strings.Split(valuesRaw, ",") {
+			if tag == "iodef" && !strings.HasPrefix(value, "mailto:") && !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "http://") {
+				log.Fatalf("%s environment variable is invalid: %s", variable, value)
+			}
+			properties = append(properties, caaProperty{tag: tag, value: value})
+		}
+	}
+
+	caaForBacknames := false
+	if caaForBacknamesRaw := os.Getenv("CAA_FOR_BACKNAMES"); caaForBacknamesRaw != "" {
+		var err error
+		if caaForBacknames, err = strconv.ParseBool(caaForBacknamesRaw); err != nil {
+			log.Fatalf("CAA_FOR_BACKNAMES environment variable is invalid: %s", caaForBacknamesRaw)
+		}
+	}
+	return properties, caaForBacknames
+}
+
+func (h *DNSHandler) caaRRs() []dns.RR {
+	var records []dns.RR
+	for _, property := range h.caa {
+		records = append(records, &dns.CAA{
+			Hdr: dns.RR_Header{
+				Ttl: h.ttlFor(ttlClassTXT),
+			},
+			Tag:   property.tag,
+			Value: property.value,
+		})
+	}
+	return records
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvesCAAAtApex(t *testing.T) {
+	handler := DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+		caa: []caaProperty{
+			{tag: "issue", value: "letsencrypt.org"},
+			{tag: "iodef", value: "mailto:security@example.com"},
+		},
+	}
+
+	answers, rcode := handler.ResolveRRs(dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeCAA,
+		Qclass: dns.ClassINET,
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []dns.RR{
+		&dns.CAA{
+			Hdr: dns.RR_Header{
+				Name:   "example.com.",
+				Rrtype: dns.TypeCAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Tag:   "issue",
+			Value: "letsencrypt.org",
+		},
+		&dns.CAA{
+			Hdr: dns.RR_Header{
+				Name:   "example.com.",
+				Rrtype: dns.TypeCAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Tag:   "iodef",
+			Value: "mailto:security@example.com",
+		},
+	}, answers)
+}
+
+func TestResolvesCAAForBacknamesOnlyIfEnabled(t *testing.T) {
+	handler := DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+		caa: []caaProperty{
+			{tag: "issuewild", value: ";"},
+		},
+	}
+
+	answers_disabled, rcode_disabled := handler.ResolveRRs(dns.Question{
+		Name:   "10-0-0-1.example.com.",
+		Qtype:  dns.TypeCAA,
+		Qclass: dns.ClassINET,
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode_disabled)
+	assert.Equal(t, []dns.RR(nil), answers_disabled)
+
+	handler.caaForBacknames = true
+
+	answers_ipv4, rcode_ipv4 := handler.ResolveRRs(dns.Question{
+		Name:   "10-0-0-1.example.com.",
+		Qtype:  dns.TypeCAA,
+		Qclass: dns.ClassINET,
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode_ipv4)
+	assert.Equal(t, []dns.RR{
+		&dns.CAA{
+			Hdr: dns.RR_Header{
+				Name:   "10-0-0-1.example.com.",
+				Rrtype: dns.TypeCAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Tag:   "issuewild",
+			Value: ";",
+		},
+	}, answers_ipv4)
+
+	answers_ipv6, rcode_ipv6 := handler.ResolveRRs(dns.Question{
+		Name:   "2001-db8--1.example.com.",
+		Qtype:  dns.TypeCAA,
+		Qclass: dns.ClassINET,
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode_ipv6)
+	assert.Len(t, answers_ipv6, 1)
+}
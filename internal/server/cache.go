@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Names whose answers only depend on the configuration, relative to the zone
+var staticResponseNames = [...]string{"", "www.", "alpha.", "omega."}
+
+// Record types cached for each static name
+var staticResponseTypes = [...]uint16{
+	dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeNS, dns.TypeTXT, dns.TypeSOA, dns.TypeCAA,
+}
+
+// A packed response, ready to go out once the ID, flags and question name are patched in
+type staticResponse struct {
+	wire []byte
+	// Size as counted by dns.Msg.Len, which trimResponse compares against the client's limit
+	size  int
+	rcode int
+}
+
+// Length of the query type and OPT presence at the start of a cache key
+const staticResponseKeyPrefixSize = 3
+
+// Build the key of a cached response: the query type, whether the query has an OPT record, and the lowercased name
+func appendStaticResponseKey(key []byte, qtype uint16, edns bool, name []byte) []byte {
+	key = append(key, byte(qtype>>8), byte(qtype), 0)
+	if edns {
+		key[len(key)-1] = 1
+	}
+	return append(key, name...)
+}
+
+// Precompute the responses for the static names. The configuration is only read at startup, so InitFromEnv builds
+// them once it's done with it
+func (h *DNSHandler) rebuildStaticResponses() {
+	responses := make(map[string]staticResponse, len(staticResponseNames)*len(staticResponseTypes)*2)
+	for _, name := range staticResponseNames {
+		for _, qtype := range staticResponseTypes {
+			for _, edns := range []bool{false, true} {
+				query := new(dns.Msg).SetQuestion(name+h.zone, qtype)
+				query.Id = 0
+				// Same as ServeDNS for an unsigned query without cookies, minus the logging and rate limiting
+				msg := new(dns.Msg)
+				msg.SetReply(query)
+				msg.Authoritative = true
+				if edns {
+					responseOPT := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+					responseOPT.SetUDPSize(ednsUDPSize)
+					msg.Extra = append(msg.Extra, responseOPT)
+				}
+				answers, rcode := h.resolveRRs(query.Question[0])
+				msg.Answer = append(msg.Answer, answers...)
+				msg.SetRcode(query, rcode)
+				h.addAuthorityAndAdditional(msg, qtype)
+				msg.Answer = h.withoutPrivilegedTypes(msg.Answer)
+				msg.Ns = h.withoutPrivilegedTypes(msg.Ns)
+				msg.Extra = h.withoutPrivilegedTypes(msg.Extra)
+				msg.Compress = true
+
+				wire, err := msg.Pack()
+				if err != nil {
+					continue // Left to ServeDNS, which will report the problem
+				}
+				key := appendStaticResponseKey(nil, qtype, edns, []byte(name+h.zone))
+				responses[string(key)] = staticResponse{wire: wire, size: msg.Len(), rcode: rcode}
+			}
+		}
+	}
+	h.staticResponses.Store(&responses)
+}
+
+// Write the cached response to a query for a static name, if there's one that fits, patching in the query's ID, RD
+// and CD flags and question name, and report whether it was written (or dropped by the rate limiter). Only valid for
+// unsigned queries without cookies, as ServeDNS answers any others differently
+func (h *DNSHandler) writeStaticResponse(w dns.ResponseWriter, r *dns.Msg) bool {
+	question := r.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return false
+	}
+	responses := h.staticResponses.Load()
+	if responses == nil {
+		return false
+	}
+	key := appendStaticResponseKey(nil, question.Qtype, r.IsEdns0() != nil, []byte(strings.ToLower(question.Name)))
+	cached, ok := (*responses)[string(key)]
+	if !ok {
+		return false
+	}
+	// A response that would need trimming for this client is left to the regular path
+	if _, overUDP := w.RemoteAddr().(*net.UDPAddr); overUDP && cached.size > maxUDPResponseSize(r) {
+		return false
+	}
+	log.Printf("Resolving %s records for %s\n", dns.TypeToString[question.Qtype], question.Name)
+
+	switch h.rateLimit(w, r, cached.rcode, cookieMissing) {
+	case rrlActionDrop:
+		return true
+	case rrlActionSlip:
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Authoritative = true
+		msg.Rcode = cached.rcode
+		msg.Truncated = true
+		w.WriteMsg(msg)
+		return true
+	}
+
+	response := append([]byte(nil), cached.wire...)
+	binary.BigEndian.PutUint16(response, r.Id)
+	const rd, cd = 1 << 8, 1 << 4
+	flags := binary.BigEndian.Uint16(response[2:]) &^ (rd | cd)
+	if r.RecursionDesired {
+		flags |= rd
+	}
+	if r.CheckingDisabled {
+		flags |= cd
+	}
+	binary.BigEndian.PutUint16(response[2:], flags)
+	// The question name as cased in the query, since resolvers may check it (0x20 randomization). Cached names are
+	// made of hostname characters only, so the name's characters are the labels' in order
+	offset := wireHeaderSize
+	for i := 0; response[offset] != 0; offset++ {
+		labelLength := int(response[offset])
+		copy(response[offset+1:offset+1+labelLength], question.Name[i:i+labelLength])
+		i += labelLength + 1
+		offset += labelLength
+	}
+	w.Write(response)
+	return true
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStaticHandler() *DNSHandler {
+	handler := &DNSHandler{
+		zone:        "example.com.",
+		websiteA:    []net.IP{websiteA},
+		websiteAAAA: []net.IP{websiteAAAA},
+		nsA:         []net.IP{testNsA1, testNsA12},
+		nsAAAA:      []net.IP{testNsAAAA1, testNsAAAA2},
+		rootTXT:     []string{"v=spf1 -all"},
+		caa:         []caaProperty{{tag: "issue", value: "letsencrypt.org"}},
+	}
+	handler.serial = 2024010100
+	handler.rebuildStaticResponses()
+	return handler
+}
+
+// Serve the query without the cached responses, as they'd be built
+func serveUncachedDNSWire(t testing.TB, handler *DNSHandler, query *dns.Msg) []byte {
+	responses := handler.staticResponses.Swap(nil)
+	defer handler.staticResponses.Store(responses)
+	return serveDNSWire(t, handler, query)
+}
+
+func TestCachedResponsesMatchServeDNS(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestStaticHandler()
+	reader := newTestFastPathReader(handler)
+	testCachedResponsesMatchServeDNS(t, handler, reader)
+
+	// Including the NS set in the authority section
+	handler.authorityNS = true
+	handler.rebuildStaticResponses()
+	testCachedResponsesMatchServeDNS(t, handler, reader)
+}
+
+func testCachedResponsesMatchServeDNS(t *testing.T, handler *DNSHandler, reader *fastPathReader) {
+	for _, name := range []string{"example.com.", "www.example.com.", "alpha.example.com.", "omega.example.com."} {
+		for _, qtype := range staticResponseTypes {
+			for _, edns := range []bool{false, true} {
+				query := new(dns.Msg).SetQuestion(name, qtype)
+				if edns {
+					query.SetEdns0(4096, false)
+				}
+				wire, err := query.Pack()
+				assert.NoError(t, err)
+
+				response, handled := reader.answer(wire, testFastPathClient)
+
+				assert.True(t, handled, "%s %s", name, dns.TypeToString[qtype])
+				assert.Equal(t, serveUncachedDNSWire(t, handler, query), response, "%s %s", name, dns.TypeToString[qtype])
+			}
+		}
+	}
+}
+
+func TestServesCachedResponsesWithoutFastPath(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestStaticHandler()
+	// Same as the default udp://:53, on a free port
+	listener, err := ParseListener("udp://:0?sockets=1")
+	assert.NoError(t, err)
+	assert.False(t, listener.FastPath)
+	addr := startTestServers(t, handler, listener)
+	_, port, _ := net.SplitHostPort(addr)
+	// Out of date, so that answers can only come from the cached responses
+	handler.rootTXT = []string{"v=spf1 mx -all"}
+	query := new(dns.Msg).SetQuestion("ExAmple.COM.", dns.TypeTXT)
+	query.CheckingDisabled = true
+
+	reply, err := dns.Exchange(query, net.JoinHostPort("127.0.0.1", port))
+
+	assert.NoError(t, err)
+	assert.Equal(t, query.Id, reply.Id)
+	assert.Equal(t, query.Question, reply.Question)
+	assert.True(t, reply.Authoritative)
+	assert.True(t, reply.RecursionDesired)
+	assert.True(t, reply.CheckingDisabled)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, []string{"v=spf1 -all"}, reply.Answer[0].(*dns.TXT).Txt)
+	}
+
+	// Over TCP too
+	tcpListener, err := ParseListener("tcp://127.0.0.1:0")
+	assert.NoError(t, err)
+
+	reply, _, err = (&dns.Client{Net: "tcp"}).Exchange(query, startTestServers(t, handler, tcpListener))
+
+	assert.NoError(t, err)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, []string{"v=spf1 -all"}, reply.Answer[0].(*dns.TXT).Txt)
+	}
+}
+
+func TestCachedResponsesLeaveOutPrivilegedTypes(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestStaticHandler()
+	handler.privilegedTypes = map[uint16]bool{dns.TypeSOA: true, dns.TypeAAAA: true}
+	handler.rebuildStaticResponses()
+	reader := newTestFastPathReader(handler)
+
+	for _, qtype := range []uint16{dns.TypeNS, dns.TypeA, dns.TypeCNAME} {
+		query := new(dns.Msg).SetQuestion("example.com.", qtype)
+		wire, err := query.Pack()
+		assert.NoError(t, err)
+
+		response, handled := reader.answer(wire, testFastPathClient)
+
+		assert.True(t, handled, dns.TypeToString[qtype])
+		assert.Equal(t, serveUncachedDNSWire(t, handler, query), response, dns.TypeToString[qtype])
+		reply := new(dns.Msg)
+		assert.NoError(t, reply.Unpack(response))
+		for _, record := range append(reply.Ns, reply.Extra...) {
+			assert.False(t, handler.privilegedTypes[record.Header().Rrtype], record.String())
+		}
+	}
+}
+
+func TestCachedResponsesKeepQueryIDAndCase(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestStaticHandler()
+	reader := newTestFastPathReader(handler)
+	query := new(dns.Msg).SetQuestion("WwW.ExAmple.cOm.", dns.TypeA)
+	query.CheckingDisabled = true
+	wire, err := query.Pack()
+	assert.NoError(t, err)
+
+	response, handled := reader.answer(wire, testFastPathClient)
+
+	assert.True(t, handled)
+	reply := new(dns.Msg)
+	assert.NoError(t, reply.Unpack(response))
+	expected := new(dns.Msg)
+	assert.NoError(t, expected.Unpack(serveUncachedDNSWire(t, handler, query)))
+	assert.Equal(t, query.Id, reply.Id)
+	assert.Equal(t, query.Question, reply.Question)
+	assert.True(t, reply.RecursionDesired)
+	assert.True(t, reply.CheckingDisabled)
+	assert.Equal(t, strings.ToLower(expected.String()), strings.ToLower(reply.String()))
+}
+
+func TestCachedResponsesAreRebuilt(t *testing.T) {
+	handler := newTestStaticHandler()
+	reader := newTestFastPathReader(handler)
+	wire, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT).Pack()
+	assert.NoError(t, err)
+
+	handler.rootTXT = []string{"v=spf1 mx -all"}
+	handler.rebuildStaticResponses()
+	response, handled := reader.answer(wire, testFastPathClient)
+
+	assert.True(t, handled)
+	reply := new(dns.Msg)
+	assert.NoError(t, reply.Unpack(response))
+	assert.Equal(t, []string{"v=spf1 mx -all"}, reply.Answer[0].(*dns.TXT).Txt)
+}
+
+func TestLeavesCachedResponsesNeedingTrimmingToServeDNS(t *testing.T) {
+	handler := newTestStaticHandler()
+	handler.rootTXT = []string{strings.Repeat("a", 250), strings.Repeat("b", 250), strings.Repeat("c", 250)}
+	handler.rebuildStaticResponses()
+	reader := newTestFastPathReader(handler)
+	query := new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT)
+	wire, err := query.Pack()
+	assert.NoError(t, err)
+
+	_, handled := reader.answer(wire, testFastPathClient)
+
+	assert.False(t, handled)
+
+	query.SetEdns0(1232, false)
+	wire, err = query.Pack()
+	assert.NoError(t, err)
+
+	_, handled = reader.answer(wire, testFastPathClient)
+
+	assert.True(t, handled)
+}
+
+func TestCachedResponsesDoNotAllocate(t *testing.T) {
+	handler := newTestStaticHandler()
+	handler.rateLimiter = newRateLimiter(1e9, 1e9, 1e9)
+	reader := newTestFastPathReader(handler)
+	wire, err := new(dns.Msg).SetQuestion("Example.com.", dns.TypeNS).SetEdns0(4096, false).Pack()
+	assert.NoError(t, err)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, handled := reader.answer(wire, testFastPathClient); !handled {
+			t.Fatal("query not handled")
+		}
+	})
+
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkStaticResponses(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestStaticHandler()
+
+	for _, qtype := range []uint16{dns.TypeNS, dns.TypeA, dns.TypeSOA} {
+		wire, err := new(dns.Msg).SetQuestion("example.com.", qtype).SetEdns0(4096, false).Pack()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(dns.TypeToString[qtype]+"/ServeDNS", func(b *testing.B) {
+			writer := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: testFastPathClient.AsSlice(), Port: 5353}}
+			b.ReportAllocs()
+			for range b.N {
+				unpacked := new(dns.Msg)
+				if err := unpacked.Unpack(wire); err != nil {
+					b.Fatal(err)
+				}
+				handler.ServeDNS(writer, unpacked)
+				if _, err := writer.messages[0].Pack(); err != nil {
+					b.Fatal(err)
+				}
+				writer.messages = writer.messages[:0]
+			}
+		})
+
+		b.Run(dns.TypeToString[qtype]+"/Cache", func(b *testing.B) {
+			reader := newTestFastPathReader(handler)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, handled := reader.answer(wire, testFastPathClient); !handled {
+					b.Fatal("query not handled")
+				}
+			}
+		})
+	}
+}
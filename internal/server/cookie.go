@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Outcome of checking the DNS cookie of a request (RFC 7873)
+const (
+	cookieMissing = iota
+	cookieClientOnly
+	cookieInvalid
+	cookieValid
+	cookieMalformed
+)
+
+const (
+	clientCookieLength = 8
+	// Server cookies as specified by RFC 9018: version, 3 reserved bytes, timestamp and SipHash-2-4
+	serverCookieLength  = 16
+	serverCookieVersion = 1
+	// How long ago a server cookie can have been issued to still be accepted
+	serverCookieLifetime = time.Hour
+	// How far into the future a server cookie's timestamp can be, to account for clock skew between instances
+	serverCookieClockSkew = 5 * time.Minute
+)
+
+// Load cookie secrets from the COOKIE_SECRETS environment variable, generating a random one if it's unset
+func cookieSecretsFromEnv() [][16]byte {
+	var secrets [][16]byte
+	if cookieSecretsRaw := os.Getenv("COOKIE_SECRETS"); cookieSecretsRaw != "" {
+		for _, cookieSecretRaw := range strings.Split(cookieSecretsRaw, ",") {
+			var secret [16]byte
+			if decoded, err := hex.DecodeString(cookieSecretRaw); err == nil && len(decoded) == len(secret) {
+				copy(secret[:], decoded)
+				secrets = append(secrets, secret)
+			} else {
+				log.Fatalf("COOKIE_SECRETS environment variable is invalid: %s", cookieSecretRaw)
+			}
+		}
+	} else {
+		var secret [16]byte
+		if _, err := rand.Read(secret[:]); err != nil {
+			log.Fatalf("Failed to generate a cookie secret: %v", err)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+// Compute the server cookie for the given client cookie, client address and timestamp
+func computeServerCookie(secret [16]byte, clientCookie []byte, client net.IP, timestamp uint32) []byte {
+	if ipv4 := client.To4(); ipv4 != nil {
+		client = ipv4
+	}
+	input := make([]byte, 0, clientCookieLength+8+net.IPv6len)
+	input = append(input, clientCookie...)
+	input = append(input, serverCookieVersion, 0, 0, 0)
+	input = binary.BigEndian.AppendUint32(input, timestamp)
+	input = append(input, client...)
+
+	serverCookie := make([]byte, 8, serverCookieLength)
+	serverCookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(serverCookie[4:], timestamp)
+	return binary.LittleEndian.AppendUint64(serverCookie, sipHash24(secret, input))
+}
+
+// Check whether the server cookie was issued by us (with any of the secrets) to this client, and recently enough
+func (h *DNSHandler) isServerCookieValid(clientCookie, serverCookie []byte, client net.IP, now time.Time) bool {
+	if len(serverCookie) != serverCookieLength || serverCookie[0] != serverCookieVersion {
+		return false
+	}
+	timestamp := binary.BigEndian.Uint32(serverCookie[4:8])
+	// Serial number arithmetic, so that cookies keep working across the 32-bit timestamp wrap-around
+	age := time.Duration(int32(uint32(now.Unix())-timestamp)) * time.Second
+	if age > serverCookieLifetime || age < -serverCookieClockSkew {
+		return false
+	}
+	for _, secret := range h.cookieSecrets {
+		if string(computeServerCookie(secret, clientCookie, client, timestamp)) == string(serverCookie) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the COOKIE option of the request, attaching a fresh server cookie to the response if the client sent one
+func (h *DNSHandler) processCookie(requestOPT, responseOPT *dns.OPT, client net.IP) int {
+	if len(h.cookieSecrets) == 0 || client == nil {
+		return cookieMissing
+	}
+	var cookie []byte
+	for _, option := range requestOPT.Option {
+		if cookieOption, ok := option.(*dns.EDNS0_COOKIE); ok {
+			decoded, err := hex.DecodeString(cookieOption.Cookie)
+			if err != nil {
+				return cookieMalformed
+			}
+			cookie = decoded
+			break
+		}
+	}
+	if cookie == nil {
+		return cookieMissing
+	}
+	// The client cookie is always 8 bytes, and the server cookie between 8 and 32 bytes (RFC 7873 section 5.2.2)
+	if len(cookie) != clientCookieLength && (len(cookie) < clientCookieLength+8 || len(cookie) > clientCookieLength+32) {
+		return cookieMalformed
+	}
+	clientCookie, serverCookie := cookie[:clientCookieLength], cookie[clientCookieLength:]
+
+	now := time.Now()
+	status := cookieClientOnly
+	if len(serverCookie) > 0 {
+		if h.isServerCookieValid(clientCookie, serverCookie, client, now) {
+			status = cookieValid
+		} else {
+			status = cookieInvalid
+		}
+	}
+
+	freshServerCookie := computeServerCookie(h.cookieSecrets[0], clientCookie, client, uint32(now.Unix()))
+	responseOPT.Option = append(responseOPT.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(clientCookie) + hex.EncodeToString(freshServerCookie),
+	})
+	return status
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+var testCookieSecret = [16]byte{0xe5, 0xe9, 0x73, 0xe5, 0xa6, 0xb2, 0xa4, 0x3f, 0x48, 0xe7, 0xdc, 0x84, 0x9e, 0x37, 0xbf, 0xcf}
+
+func TestSipHash24ReferenceVector(t *testing.T) {
+	var key [16]byte
+	message := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range message {
+		message[i] = byte(i)
+	}
+
+	assert.Equal(t, uint64(0xa129ca6149be45e5), sipHash24(key, message))
+}
+
+func TestComputesServerCookiesPerRFC9018(t *testing.T) {
+	clientCookie, _ := hex.DecodeString("2464c4abcf10c957")
+	serverCookie := computeServerCookie(testCookieSecret, clientCookie, net.ParseIP("198.51.100.100"), 1559731985)
+	assert.Equal(t, "010000005cf79f111f8130c3eee29480", hex.EncodeToString(serverCookie))
+
+	// IPv4 addresses are hashed in their 4-byte form, however they're represented
+	serverCookie = computeServerCookie(testCookieSecret, clientCookie, net.IPv4(198, 51, 100, 100).To4(), 1559731985)
+	assert.Equal(t, "010000005cf79f111f8130c3eee29480", hex.EncodeToString(serverCookie))
+}
+
+func newCookieQuery(name string, cookie string) *dns.Msg {
+	query := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	query.SetEdns0(1232, false)
+	if cookie != "" {
+		opt := query.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	return query
+}
+
+func responseCookie(t *testing.T, msg *dns.Msg) string {
+	opt := msg.IsEdns0()
+	if !assert.NotNil(t, opt) {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+			return cookie.Cookie
+		}
+	}
+	return ""
+}
+
+func TestServeDNSIssuesAndValidatesServerCookies(t *testing.T) {
+	previousSecret := [16]byte{1}
+	handler := DNSHandler{
+		zone:          "example.com.",
+		nsA:           []net.IP{testNsA1},
+		cookieSecrets: [][16]byte{testCookieSecret, previousSecret},
+	}
+	client := net.ParseIP("192.0.2.1")
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: client, Port: 5353}}
+
+	handler.ServeDNS(w, newCookieQuery("10-0-0-1.example.com.", "2464c4abcf10c957"))
+
+	cookie := responseCookie(t, w.messages[0])
+	assert.Len(t, cookie, 2*(clientCookieLength+serverCookieLength))
+	assert.Equal(t, "2464c4abcf10c957", cookie[:16])
+	assert.Len(t, w.messages[0].Answer, 1)
+
+	clientCookie, _ := hex.DecodeString("2464c4abcf10c957")
+	serverCookie, _ := hex.DecodeString(cookie[16:])
+	assert.True(t, handler.isServerCookieValid(clientCookie, serverCookie, client, time.Now()))
+	assert.False(t, handler.isServerCookieValid(clientCookie, serverCookie, net.ParseIP("192.0.2.2"), time.Now()))
+	assert.False(t, handler.isServerCookieValid(clientCookie, serverCookie, client, time.Now().Add(2*time.Hour)))
+
+	// Cookies issued with a previous secret stay valid during rotation
+	rotatedCookie := computeServerCookie(previousSecret, clientCookie, client, uint32(time.Now().Unix()))
+	assert.True(t, handler.isServerCookieValid(clientCookie, rotatedCookie, client, time.Now()))
+}
+
+func TestServeDNSRejectsMalformedCookies(t *testing.T) {
+	handler := DNSHandler{
+		zone:          "example.com.",
+		nsA:           []net.IP{testNsA1},
+		cookieSecrets: [][16]byte{testCookieSecret},
+	}
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+
+	handler.ServeDNS(w, newCookieQuery("10-0-0-1.example.com.", "2464c4abcf10c95701"))
+
+	assert.Equal(t, dns.RcodeFormatError, w.messages[0].Rcode)
+	assert.Empty(t, w.messages[0].Answer)
+}
+
+func TestServeDNSLetsValidCookiesBypassRateLimiting(t *testing.T) {
+	handler := DNSHandler{
+		zone:          "example.com.",
+		nsA:           []net.IP{testNsA1},
+		cookieSecrets: [][16]byte{testCookieSecret},
+		rateLimiter:   newRateLimiter(1, 1, 1),
+	}
+	handler.rateLimiter.slip = 1
+	client := net.ParseIP("192.0.2.1")
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: client, Port: 5353}}
+
+	handler.ServeDNS(w, newCookieQuery("10-0-0-1.example.com.", "2464c4abcf10c957"))
+	handler.ServeDNS(w, newCookieQuery("10-0-0-1.example.com.", "2464c4abcf10c957"))
+
+	// Over the limit, a client with a cookie is told to come back with a valid server cookie
+	assert.Equal(t, dns.RcodeSuccess, w.messages[0].Rcode)
+	assert.Equal(t, dns.RcodeBadCookie, w.messages[1].Rcode)
+	assert.Empty(t, w.messages[1].Answer)
+
+	cookie := responseCookie(t, w.messages[1])
+	for i := 0; i < 5; i++ {
+		handler.ServeDNS(w, newCookieQuery("10-0-0-1.example.com.", cookie))
+	}
+
+	assert.Len(t, w.messages, 7)
+	for _, msg := range w.messages[2:] {
+		assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+		assert.Len(t, msg.Answer, 1)
+	}
+}
+
+func TestServeDNSRejectsUnknownEDNSVersions(t *testing.T) {
+	handler := DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	query := newCookieQuery("10-0-0-1.example.com.", "")
+	query.IsEdns0().SetVersion(1)
+
+	handler.ServeDNS(w, query)
+
+	assert.Equal(t, dns.RcodeBadVers, w.messages[0].Rcode)
+	assert.Equal(t, uint8(0), w.messages[0].IsEdns0().Version())
+}
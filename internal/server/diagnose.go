@@ -0,0 +1,188 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Nameservers of the zone as a parent delegates to them, with their glue addresses
+type delegation struct {
+	nameservers []string
+	glue        map[string][]net.IP
+}
+
+// Diagnose the delegation of the zone at the given parent nameserver (host or host:port) against what this handler
+// serves, returning the problems found: mismatched nameservers or glue, missing IPv6 glue and lame delegation. The
+// delegated nameservers are checked for lameness on nameserverPort, normally 53
+func (h *DNSHandler) DiagnoseDelegation(parent, nameserverPort string, timeout time.Duration) ([]string, error) {
+	if _, _, err := net.SplitHostPort(parent); err != nil {
+		parent = net.JoinHostPort(parent, "53")
+	}
+	client := &dns.Client{Net: "udp", Timeout: timeout}
+	parentDelegation, err := queryDelegation(client, parent, h.zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	if len(parentDelegation.nameservers) == 0 {
+		return append(problems, fmt.Sprintf("%s does not delegate %s", parent, h.zone)), nil
+	}
+
+	// Nameservers and addresses that the handler serves
+	served := []string{"alpha." + h.zone}
+	if len(h.nsA) > 1 {
+		served = append(served, "omega."+h.zone)
+	}
+	servedAddresses := make(map[string][]net.IP)
+	for i, nameserver := range served {
+		servedAddresses[nameserver] = append(servedAddresses[nameserver], h.nsA[i])
+		if i < len(h.nsAAAA) {
+			servedAddresses[nameserver] = append(servedAddresses[nameserver], h.nsAAAA[i])
+		}
+	}
+
+	for _, nameserver := range served {
+		if !slices.Contains(parentDelegation.nameservers, nameserver) {
+			problems = append(problems, fmt.Sprintf("%s is not delegated to at %s", nameserver, parent))
+		}
+	}
+	for _, nameserver := range parentDelegation.nameservers {
+		expected, ok := servedAddresses[nameserver]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s delegates to %s, which is not served by backname", parent, nameserver))
+			continue
+		}
+		glue := parentDelegation.glue[nameserver]
+		problems = append(problems, compareGlue(nameserver, glue, expected, false)...)
+		problems = append(problems, compareGlue(nameserver, glue, expected, true)...)
+
+		// Resolvers use the glue, so that's what has to answer, with the configured addresses as a fallback
+		addresses := glue
+		if len(addresses) == 0 {
+			addresses = expected
+		}
+		for _, address := range addresses {
+			if problem := checkLameness(client, nameserver, address, nameserverPort, h.zone); problem != "" {
+				problems = append(problems, problem)
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Query the parent for the NS records of the zone, without recursion, collecting the referral or the answer
+func queryDelegation(client *dns.Client, parent, zone string) (*delegation, error) {
+	query := new(dns.Msg).SetQuestion(zone, dns.TypeNS)
+	query.RecursionDesired = false
+	reply, _, err := client.Exchange(query, parent)
+	if err != nil {
+		return nil, fmt.Errorf("query to %s failed: %w", parent, err)
+	}
+	if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s answered %s", parent, dns.RcodeToString[reply.Rcode])
+	}
+
+	result := &delegation{glue: make(map[string][]net.IP)}
+	for _, record := range slices.Concat(reply.Answer, reply.Ns) {
+		if ns, ok := record.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, zone) {
+			nameserver := strings.ToLower(ns.Ns)
+			if !slices.Contains(result.nameservers, nameserver) {
+				result.nameservers = append(result.nameservers, nameserver)
+			}
+		}
+	}
+	for _, record := range reply.Extra {
+		nameserver := strings.ToLower(record.Header().Name)
+		switch record := record.(type) {
+		case *dns.A:
+			result.glue[nameserver] = append(result.glue[nameserver], record.A)
+		case *dns.AAAA:
+			result.glue[nameserver] = append(result.glue[nameserver], record.AAAA)
+		}
+	}
+	return result, nil
+}
+
+// Compare the IPv4 or IPv6 glue of a nameserver with the addresses it's configured with
+func compareGlue(nameserver string, glue, expected []net.IP, ipv6 bool) []string {
+	family, variable := "IPv4", "NAMESERVER_A"
+	if ipv6 {
+		family, variable = "IPv6", "NAMESERVER_AAAA"
+	}
+	isFamily := func(ip net.IP) bool { return (ip.To4() == nil) == ipv6 }
+	glue = slices.DeleteFunc(slices.Clone(glue), func(ip net.IP) bool { return !isFamily(ip) })
+	expected = slices.DeleteFunc(slices.Clone(expected), func(ip net.IP) bool { return !isFamily(ip) })
+
+	var problems []string
+	switch {
+	case len(glue) == 0 && len(expected) == 0:
+	case len(glue) == 0:
+		problems = append(problems, fmt.Sprintf("%s is missing %s glue, which should be %s", nameserver, family, joinIPs(expected)))
+	case len(expected) == 0:
+		problems = append(problems, fmt.Sprintf("%s has %s glue %s, but %s doesn't configure any", nameserver, family, joinIPs(glue), variable))
+	default:
+		for _, ip := range glue {
+			if !slices.ContainsFunc(expected, ip.Equal) {
+				problems = append(problems, fmt.Sprintf("%s has %s glue %s, but %s says %s", nameserver, family, ip, variable, joinIPs(expected)))
+			}
+		}
+		for _, ip := range expected {
+			if !slices.ContainsFunc(glue, ip.Equal) {
+				problems = append(problems, fmt.Sprintf("%s is missing %s glue %s", nameserver, family, ip))
+			}
+		}
+	}
+	return problems
+}
+
+// Check that the nameserver at the address answers authoritatively for the zone, returning the problem if not
+func checkLameness(client *dns.Client, nameserver string, address net.IP, port, zone string) string {
+	addr := net.JoinHostPort(address.String(), port)
+	query := new(dns.Msg).SetQuestion(zone, dns.TypeSOA)
+	query.RecursionDesired = false
+	reply, _, err := client.Exchange(query, addr)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("%s at %s does not answer, so the delegation is lame (%v)", nameserver, addr, err)
+	case reply.Rcode != dns.RcodeSuccess:
+		return fmt.Sprintf("%s at %s answers %s for %s, so the delegation is lame", nameserver, addr, dns.RcodeToString[reply.Rcode], zone)
+	case !reply.Authoritative || !slices.ContainsFunc(reply.Answer, func(record dns.RR) bool { return record.Header().Rrtype == dns.TypeSOA }):
+		return fmt.Sprintf("%s at %s is not authoritative for %s, so the delegation is lame", nameserver, addr, zone)
+	}
+	return ""
+}
+
+func joinIPs(ips []net.IP) string {
+	ipsRaw := make([]string, len(ips))
+	for i, ip := range ips {
+		ipsRaw[i] = ip.String()
+	}
+	return strings.Join(ipsRaw, ", ")
+}
+
+// Diagnose the delegation at the parent set in the DIAGNOSE_PARENT environment variable, if any, logging the problems
+func (h *DNSHandler) DiagnoseDelegationFromEnv() {
+	parent := os.Getenv("DIAGNOSE_PARENT")
+	if parent == "" {
+		return
+	}
+	problems, err := h.DiagnoseDelegation(parent, "53", 5*time.Second)
+	if err != nil {
+		log.Printf("Failed to diagnose delegation: %v\n", err)
+		return
+	}
+	for _, problem := range problems {
+		log.Printf("Delegation problem: %s\n", problem)
+	}
+	if len(problems) == 0 {
+		log.Printf("Delegation of %s at %s matches the configuration\n", h.zone, parent)
+	}
+}
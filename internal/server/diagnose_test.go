@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Start a fake parent nameserver, which answers every query with a referral to the given records
+func startTestParent(t *testing.T, rcode int, ns []dns.RR, glue []dns.RR) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		referral := new(dns.Msg)
+		referral.SetRcode(r, rcode)
+		referral.Ns = ns
+		referral.Extra = glue
+		w.WriteMsg(referral)
+	})}
+	go parent.ActivateAndServe()
+	t.Cleanup(func() { parent.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func startTestNameserver(t *testing.T, handler *DNSHandler) string {
+	addr := startTestServers(t, handler, Listener{Net: "udp", Addr: "127.0.0.1:0", UDPSize: dns.MaxMsgSize, Sockets: 1})
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
+
+func TestDiagnosesMatchingDelegation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := &DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+	port := startTestNameserver(t, handler)
+	parent := startTestParent(t, dns.RcodeSuccess,
+		[]dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "Example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ALPHA.example.com."}},
+		[]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "alpha.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: testNsA1}},
+	)
+
+	problems, err := handler.DiagnoseDelegation(parent, port, time.Second)
+
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestDiagnosesMismatchedGlueAndLameDelegation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := &DNSHandler{
+		zone:   "example.com.",
+		nsA:    []net.IP{testNsA1, testNsA12},
+		nsAAAA: []net.IP{net.ParseIP("2001:db8::53"), net.ParseIP("2001:db8::54")},
+	}
+	port := startTestNameserver(t, handler)
+	parent := startTestParent(t, dns.RcodeSuccess,
+		[]dns.RR{
+			&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "alpha.example.com."},
+			&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns1.example.net."},
+		},
+		[]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "alpha.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("127.0.0.9")}},
+	)
+
+	problems, err := handler.DiagnoseDelegation(parent, port, time.Second)
+
+	assert.NoError(t, err)
+	assert.Len(t, problems, 6)
+	assert.Equal(t, []string{
+		"omega.example.com. is not delegated to at " + parent,
+		"alpha.example.com. has IPv4 glue 127.0.0.9, but NAMESERVER_A says 127.0.0.1",
+		"alpha.example.com. is missing IPv4 glue 127.0.0.1",
+		"alpha.example.com. is missing IPv6 glue, which should be 2001:db8::53",
+	}, problems[:4])
+	assert.Contains(t, problems[4], "alpha.example.com. at 127.0.0.9:"+port+" does not answer, so the delegation is lame")
+	assert.Equal(t, parent+" delegates to ns1.example.net., which is not served by backname", problems[5])
+}
+
+func TestDiagnosesMissingDelegation(t *testing.T) {
+	handler := &DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+	parent := startTestParent(t, dns.RcodeNameError, nil, nil)
+
+	problems, err := handler.DiagnoseDelegation(parent, "53", time.Second)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{parent + " does not delegate example.com."}, problems)
+}
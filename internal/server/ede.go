@@ -0,0 +1,50 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Attach an Extended DNS Error (RFC 8914) to the response, with optional text for humans, if the client speaks EDNS
+func addExtendedError(msg *dns.Msg, infoCode uint16, extraText string) {
+	if opt := msg.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: infoCode, ExtraText: extraText})
+	}
+}
+
+// Explain an empty answer to the question with an Extended DNS Error, when it's down to policy rather than the name
+// not existing: the info code, its text, and whether there's one. Follows the order of precedence of resolveRRs
+func (h *DNSHandler) explainEmptyAnswer(question dns.Question, rcode int) (uint16, string, bool) {
+	switch rcode {
+	case dns.RcodeNotImplemented:
+		return dns.ExtendedErrorCodeNotSupported, "only the IN class is served", true
+	case dns.RcodeNotZone:
+		return dns.ExtendedErrorCodeNotAuthoritative, "name is outside " + h.zone, true
+	}
+
+	name := strings.ToLower(question.Name)
+	if !strings.HasSuffix(name, "."+h.zone) || h.lookupDynamic(question.Name) != nil {
+		return 0, "", false
+	}
+	subdomain := strings.TrimSuffix(name, "."+h.zone)
+	ip, _ := h.parseIPv6Subdomain(subdomain)
+	if ip == nil || h.isBlocked(ip) {
+		if ipv4, _ := h.parseIPv4Subdomain(subdomain); ipv4 != nil {
+			ip = ipv4
+		}
+	}
+	if ip == nil {
+		return 0, "", false
+	}
+	if entry, blocked := h.blockingEntry(ip); blocked {
+		if entry.reason == "" {
+			return dns.ExtendedErrorCodeBlocked, "address is on the blocklist", true
+		}
+		return dns.ExtendedErrorCodeBlocked, entry.reason, true
+	}
+	if !h.isAllowed(ip) {
+		return dns.ExtendedErrorCodeProhibited, "address is outside the allowlist", true
+	}
+	return 0, "", false
+}
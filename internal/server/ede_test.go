@@ -0,0 +1,82 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Serve the query with EDNS and return the Extended DNS Error of the response, if any
+func serveExtendedError(t *testing.T, handler *DNSHandler, query *dns.Msg) *dns.EDNS0_EDE {
+	query.SetEdns0(4096, false)
+	writer := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	handler.ServeDNS(writer, query)
+	if len(writer.messages) != 1 || writer.messages[0].IsEdns0() == nil {
+		t.Fatal("expected one response with EDNS")
+	}
+	for _, option := range writer.messages[0].IsEdns0().Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+func TestExplainsRefusalsWithExtendedErrors(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	blocklist := newTestBlocklist("10.20.0.4")
+	blocklist.add(blocklistEntry{ip: netip.MustParseAddr("10.20.0.5"), reason: "phishing, see ticket 42"})
+	handler := &DNSHandler{
+		zone:            "example.com.",
+		nsA:             []net.IP{testNsA1},
+		blocklist:       blocklist,
+		allowlist:       []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16")},
+		allowlistRcode:  dns.RcodeRefused,
+		privilegedTypes: map[uint16]bool{dns.TypeTXT: true},
+	}
+	chaos := new(dns.Msg).SetQuestion("10-20-0-1.example.com.", dns.TypeA)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+
+	for _, test := range []struct {
+		query     *dns.Msg
+		infoCode  uint16
+		extraText string
+	}{
+		{new(dns.Msg).SetQuestion("10-20-0-4.example.com.", dns.TypeA), dns.ExtendedErrorCodeBlocked, "address is on the blocklist"},
+		{new(dns.Msg).SetQuestion("foo.10.20.0.5.example.com.", dns.TypeAAAA), dns.ExtendedErrorCodeBlocked, "phishing, see ticket 42"},
+		{new(dns.Msg).SetQuestion("10-21-0-1.example.com.", dns.TypeA), dns.ExtendedErrorCodeProhibited, "address is outside the allowlist"},
+		{new(dns.Msg).SetQuestion("10-20-0-1.example.com.", dns.TypeTXT), dns.ExtendedErrorCodeProhibited, "query type requires a TSIG signature"},
+		{new(dns.Msg).SetQuestion("10-20-0-1.example.org.", dns.TypeA), dns.ExtendedErrorCodeNotAuthoritative, "name is outside example.com."},
+		{chaos, dns.ExtendedErrorCodeNotSupported, "only the IN class is served"},
+		{new(dns.Msg).SetQuestion("example.org.", dns.TypeAXFR), dns.ExtendedErrorCodeNotAuthoritative, "only example.com. can be transferred"},
+	} {
+		ede := serveExtendedError(t, handler, test.query)
+
+		if assert.NotNil(t, ede, test.query.Question[0].String()) {
+			assert.Equal(t, test.infoCode, ede.InfoCode, test.query.Question[0].String())
+			assert.Equal(t, test.extraText, ede.ExtraText, test.query.Question[0].String())
+		}
+	}
+
+	// Names that just don't exist, or exist without records of the type, aren't explained
+	for _, query := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("10-20-0-1.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("10-20-0-1.example.com.", dns.TypeAAAA),
+		new(dns.Msg).SetQuestion("typo.example.com.", dns.TypeA),
+	} {
+		assert.Nil(t, serveExtendedError(t, handler, query), query.Question[0].String())
+	}
+
+	// Clients without EDNS get no OPT record to carry it
+	writer := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	handler.ServeDNS(writer, new(dns.Msg).SetQuestion("10-20-0-4.example.com.", dns.TypeA))
+	assert.Nil(t, writer.messages[0].IsEdns0())
+	assert.Equal(t, dns.RcodeNameError, writer.messages[0].Rcode)
+}
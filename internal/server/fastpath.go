@@ -0,0 +1,419 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Wire format offsets and sizes
+const (
+	wireHeaderSize   = 12
+	wireRRHeaderSize = 10
+	// An OPT record without options: root name, type, class (UDP size), TTL (extended rcode and flags), RDLENGTH
+	wireBareOPTSize = 11
+	// Pointer to the question name, which always directly follows the header
+	wireQuestionNamePointer = 0xc000 | wireHeaderSize
+)
+
+// Largest IP-derived response the fast path writes: header, question with a name of up to 255 bytes, an AAAA record
+// and an OPT
+const fastPathMaxResponseSize = wireHeaderSize + 255 + 4 + 2 + wireRRHeaderSize + net.IPv6len + wireBareOPTSize
+
+// Hides the *net.UDPConn type from miekg/dns, so that the server reads through the fast path reader's ReadPacketConn
+type fastPathConn struct {
+	*net.UDPConn
+}
+
+// A reader answering the most common UDP queries, positive A and AAAA lookups of IP-derived names, straight from the
+// wire format without allocating, and handing everything else over to the server's regular ServeDNS path
+type fastPathReader struct {
+	dns.Reader
+	handler *DNSHandler
+	query   []byte
+	// Grows to fit the largest cached response written
+	response []byte
+	// Scratch space for the cache key, ending with the lowercased question name, and IP address text parsed from it
+	key  [staticResponseKeyPrefixSize + 255]byte
+	text [255]byte
+}
+
+func newFastPathReader(reader dns.Reader, handler *DNSHandler, udpSize int) *fastPathReader {
+	return &fastPathReader{
+		Reader:   reader,
+		handler:  handler,
+		query:    make([]byte, udpSize),
+		response: make([]byte, 0, fastPathMaxResponseSize),
+	}
+}
+
+func (r *fastPathReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	udpConn := conn.(fastPathConn).UDPConn
+	for {
+		n, client, err := udpConn.ReadFromUDPAddrPort(r.query)
+		if err != nil {
+			return nil, nil, err
+		}
+		response, handled := r.answer(r.query[:n], client.Addr())
+		if !handled {
+			// The query buffer is reused, so the server gets its own copy
+			query := make([]byte, n)
+			copy(query, r.query[:n])
+			return query, net.UDPAddrFromAddrPort(client), nil
+		}
+		if response != nil {
+			// Just like the regular path, a failed write only affects this one response
+			_, _ = udpConn.WriteToUDPAddrPort(response, client)
+		}
+	}
+}
+
+// Answer the query if it's for a static name with a cached response, or a plain positive A or AAAA lookup of an
+// IP-derived name. The response is nil if the query was handled by dropping it, and handled is false if the query
+// has to go through ServeDNS instead
+func (r *fastPathReader) answer(query []byte, client netip.Addr) (response []byte, handled bool) {
+	h := r.handler
+	// A standard query with a single question and at most an OPT record
+	if len(query) < wireHeaderSize {
+		return nil, false
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&(1<<15) != 0 || (flags>>11)&0xf != dns.OpcodeQuery ||
+		binary.BigEndian.Uint16(query[4:]) != 1 || binary.BigEndian.Uint16(query[6:]) != 0 ||
+		binary.BigEndian.Uint16(query[8:]) != 0 || binary.BigEndian.Uint16(query[10:]) > 1 {
+		return nil, false
+	}
+
+	// Lowercase the question name into presentation format, accepting only hostname characters so that no escaping
+	// is involved
+	offset := wireHeaderSize
+	nameLength := staticResponseKeyPrefixSize
+	for {
+		if offset >= len(query) {
+			return nil, false
+		}
+		labelLength := int(query[offset])
+		offset++
+		if labelLength == 0 {
+			break
+		}
+		if labelLength > 63 || offset+labelLength > len(query) || nameLength+labelLength+1 > len(r.key) {
+			return nil, false
+		}
+		for _, c := range query[offset : offset+labelLength] {
+			switch {
+			case 'A' <= c && c <= 'Z':
+				c += 'a' - 'A'
+			case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-':
+			default:
+				return nil, false
+			}
+			r.key[nameLength] = c
+			nameLength++
+		}
+		r.key[nameLength] = '.'
+		nameLength++
+		offset += labelLength
+	}
+	questionEnd := offset + 4
+	if questionEnd > len(query) {
+		return nil, false
+	}
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	if binary.BigEndian.Uint16(query[offset+2:]) != dns.ClassINET || h.privilegedTypes[qtype] {
+		return nil, false
+	}
+
+	// The only additional record allowed is an OPT without options, as anything else (e.g. cookies) needs processing
+	hasOPT := binary.BigEndian.Uint16(query[10:]) == 1
+	if hasOPT {
+		opt := query[questionEnd:]
+		if len(opt) != wireBareOPTSize || opt[0] != 0 || binary.BigEndian.Uint16(opt[1:]) != dns.TypeOPT ||
+			opt[6] != 0 || binary.BigEndian.Uint16(opt[9:]) != 0 {
+			return nil, false
+		}
+	} else if questionEnd != len(query) {
+		return nil, false
+	}
+
+	key := appendStaticResponseKey(r.key[:0], qtype, hasOPT, nil)
+	if responses := h.staticResponses.Load(); responses != nil {
+		if cached, ok := (*responses)[string(r.key[:nameLength])]; ok {
+			maxSize := dns.MinMsgSize
+			if hasOPT {
+				maxSize = max(dns.MinMsgSize, min(int(binary.BigEndian.Uint16(query[questionEnd+3:])), ednsUDPSize))
+			}
+			// A response that would need trimming for this client is left to ServeDNS
+			if cached.size > maxSize {
+				return nil, false
+			}
+			return r.respond(query, questionEnd, client, rrlCategoryForRcode(cached.rcode), qtype, r.key[staticResponseKeyPrefixSize:nameLength], func(response []byte) []byte {
+				response = append(response, cached.wire[questionEnd:]...)
+				copy(response[4:wireHeaderSize], cached.wire[4:wireHeaderSize])
+				response[3] = response[3]&0xf0 | cached.wire[3]&0x0f
+				return response
+			})
+		}
+	}
+	// Anything that could add records beyond the answer is left to the regular path
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA || h.authorityNS {
+		return nil, false
+	}
+
+	// The subdomain, which must be separated from the zone by a label boundary
+	name := r.key[len(key):nameLength]
+	if len(name) <= len(h.zone)+1 || string(name[len(name)-len(h.zone):]) != h.zone || name[len(name)-len(h.zone)-1] != '.' {
+		return nil, false
+	}
+	subdomain := name[:len(name)-len(h.zone)-1]
+
+	// Dynamic names take precedence over IPs, and are looked up in the record store by ServeDNS
+	if h.updateSubtree != "" && len(name) > len(h.updateSubtree) && name[len(name)-len(h.updateSubtree)-1] == '.' &&
+		string(name[len(name)-len(h.updateSubtree):]) == h.updateSubtree {
+		return nil, false
+	}
+
+	// Signatures of names are only checked by ServeDNS
+	if h.nameSecret != nil {
+		return nil, false
+	}
+
+	// Same order of precedence as in resolveRRs: IPv6 first, then IPv4
+	var rdata []byte
+	if ipv6, ok := r.parseIPv6Subdomain(subdomain); ok && !h.isBlocked(ipv6[:]) {
+		if qtype != dns.TypeAAAA || !h.isAllowed(ipv6[:]) {
+			return nil, false
+		}
+		rdata = ipv6[:]
+	} else if ipv4, ok := r.parseIPv4Subdomain(subdomain); ok && !h.isBlocked(ipv4[:]) {
+		if qtype != dns.TypeA || !h.isAllowed(ipv4[:]) {
+			return nil, false
+		}
+		rdata = ipv4[:]
+	} else {
+		return nil, false
+	}
+
+	return r.respond(query, questionEnd, client, rrlCategoryResponse, qtype, name, func(response []byte) []byte {
+		response = r.writeCounts(response, 1, hasOPT)
+		response = binary.BigEndian.AppendUint16(response, wireQuestionNamePointer)
+		response = binary.BigEndian.AppendUint16(response, qtype)
+		response = binary.BigEndian.AppendUint16(response, dns.ClassINET)
+		response = binary.BigEndian.AppendUint32(response, h.ttlFor(ttlClassIP))
+		response = binary.BigEndian.AppendUint16(response, uint16(len(rdata)))
+		response = append(response, rdata...)
+		return r.appendOPT(response, hasOPT)
+	})
+}
+
+// Consult the rate limiter, then write the header and question of an authoritative response to the query into the
+// response buffer, for appendRest to append the rest of the response to
+func (r *fastPathReader) respond(query []byte, questionEnd int, client netip.Addr, category uint8, qtype uint16, name []byte, appendRest func([]byte) []byte) ([]byte, bool) {
+	action := rrlActionAllow
+	if r.handler.rateLimiter != nil {
+		action = r.handler.rateLimiter.check(client, category, qtype, name)
+	}
+	if action == rrlActionDrop {
+		return nil, true
+	}
+
+	response := append(r.response[:0], query[:questionEnd]...)
+	flags := binary.BigEndian.Uint16(query[2:])
+	// QR and AA set, RD and CD copied from the query, everything else zero
+	const rd, cd = 1 << 8, 1 << 4
+	binary.BigEndian.PutUint16(response[2:], 1<<15|1<<10|flags&(rd|cd))
+	if action == rrlActionSlip {
+		// A truncated empty response makes legitimate clients retry over TCP, as in writeResponse
+		response[2] |= 1 << 1
+		return r.writeCounts(response, 0, false), true
+	}
+	response = appendRest(response)
+	// Keep the grown buffer for the next response
+	r.response = response[:0]
+	return response, true
+}
+
+// Set the section counts of a response with just answers and possibly an OPT record
+func (r *fastPathReader) writeCounts(response []byte, answers uint16, hasOPT bool) []byte {
+	binary.BigEndian.PutUint16(response[6:], answers)
+	binary.BigEndian.PutUint16(response[8:], 0)
+	var additionals uint16
+	if hasOPT {
+		additionals = 1
+	}
+	binary.BigEndian.PutUint16(response[10:], additionals)
+	return response
+}
+
+func (r *fastPathReader) appendOPT(response []byte, hasOPT bool) []byte {
+	if !hasOPT {
+		return response
+	}
+	response = append(response, 0)
+	response = binary.BigEndian.AppendUint16(response, dns.TypeOPT)
+	response = binary.BigEndian.AppendUint16(response, ednsUDPSize)
+	response = binary.BigEndian.AppendUint32(response, 0)
+	return binary.BigEndian.AppendUint16(response, 0)
+}
+
+// Alloc-free equivalent of backname.ParseIPv6Subdomain for a lowercased subdomain of hostname characters
+func (r *fastPathReader) parseIPv6Subdomain(subdomain []byte) ([16]byte, bool) {
+	text, ok := r.subdomainIPText(subdomain, 8, ':')
+	if !ok {
+		return [16]byte{}, false
+	}
+	return parseIPv6Text(text)
+}
+
+// Alloc-free equivalent of backname.ParseIPv4Subdomain for a lowercased subdomain of hostname characters
+func (r *fastPathReader) parseIPv4Subdomain(subdomain []byte) ([4]byte, bool) {
+	text, ok := r.subdomainIPText(subdomain, 4, '.')
+	if !ok {
+		return [4]byte{}, false
+	}
+	return parseIPv4Text(text)
+}
+
+// Turn a subdomain into IP address text: its last label with dashes as separators if that label contains any, or
+// else its last labelCount labels joined by the separator
+func (r *fastPathReader) subdomainIPText(subdomain []byte, labelCount int, separator byte) ([]byte, bool) {
+	lastLabelStart := 0
+	dashed := false
+	for i := len(subdomain) - 1; i >= 0; i-- {
+		if subdomain[i] == '.' {
+			lastLabelStart = i + 1
+			break
+		} else if subdomain[i] == '-' {
+			dashed = true
+		}
+	}
+	start := lastLabelStart
+	if !dashed {
+		for labels := 1; labels < labelCount; labels++ {
+			if start == 0 {
+				return nil, false
+			}
+			start--
+			for start > 0 && subdomain[start-1] != '.' {
+				start--
+			}
+		}
+	}
+	text := r.text[:0]
+	for _, c := range subdomain[start:] {
+		if c == '-' && dashed || c == '.' && !dashed {
+			c = separator
+		}
+		text = append(text, c)
+	}
+	return text, true
+}
+
+// Parse IPv4 address text exactly like net.ParseIP does, without allocating
+func parseIPv4Text(text []byte) (ip [4]byte, ok bool) {
+	for i := range ip {
+		if i > 0 {
+			if len(text) == 0 || text[0] != '.' {
+				return ip, false
+			}
+			text = text[1:]
+		}
+		value, digits := 0, 0
+		for digits < len(text) && '0' <= text[digits] && text[digits] <= '9' {
+			if digits > 0 && value == 0 { // Leading zeros are rejected
+				return ip, false
+			}
+			value = value*10 + int(text[digits]-'0')
+			if value > 255 {
+				return ip, false
+			}
+			digits++
+		}
+		if digits == 0 {
+			return ip, false
+		}
+		ip[i] = byte(value)
+		text = text[digits:]
+	}
+	return ip, len(text) == 0
+}
+
+// Parse IPv6 address text exactly like net.ParseIP does, without allocating, except for embedded IPv4 addresses and
+// zones, which can't occur in backnames
+func parseIPv6Text(text []byte) (ip [16]byte, ok bool) {
+	ellipsis := -1 // Position of the "::" in ip, if any
+	if len(text) >= 2 && text[0] == ':' && text[1] == ':' {
+		ellipsis = 0
+		text = text[2:]
+		if len(text) == 0 {
+			return ip, true
+		}
+	}
+	i := 0
+	for i < net.IPv6len {
+		value, digits := 0, 0
+		for digits < len(text) {
+			c := text[digits]
+			switch {
+			case '0' <= c && c <= '9':
+				value = value<<4 | int(c-'0')
+			case 'a' <= c && c <= 'f':
+				value = value<<4 | int(c-'a'+10)
+			case 'A' <= c && c <= 'F':
+				value = value<<4 | int(c-'A'+10)
+			default:
+				goto groupEnd
+			}
+			digits++
+			if digits > 4 {
+				return ip, false
+			}
+		}
+	groupEnd:
+		if digits == 0 {
+			return ip, false
+		}
+		ip[i], ip[i+1] = byte(value>>8), byte(value)
+		i += 2
+		text = text[digits:]
+		if len(text) == 0 {
+			break
+		}
+		if text[0] != ':' || len(text) == 1 {
+			return ip, false
+		}
+		text = text[1:]
+		if text[0] == ':' {
+			if ellipsis >= 0 {
+				return ip, false
+			}
+			ellipsis = i
+			text = text[1:]
+			if len(text) == 0 {
+				break
+			}
+		}
+	}
+	if len(text) != 0 {
+		return ip, false
+	}
+	if i < net.IPv6len {
+		if ellipsis < 0 {
+			return ip, false
+		}
+		// Move the groups after the "::" to the end, zeroing what they leave behind
+		shift := net.IPv6len - i
+		for j := i - 1; j >= ellipsis; j-- {
+			ip[j+shift] = ip[j]
+		}
+		for j := ellipsis + shift - 1; j >= ellipsis; j-- {
+			ip[j] = 0
+		}
+	} else if ellipsis >= 0 { // The "::" must stand for at least one group
+		return ip, false
+	}
+	return ip, true
+}
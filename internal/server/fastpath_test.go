@@ -0,0 +1,271 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+var testFastPathClient = netip.MustParseAddr("192.0.2.1")
+
+func newTestFastPathReader(handler *DNSHandler) *fastPathReader {
+	return newFastPathReader(nil, handler, dns.MaxMsgSize)
+}
+
+// Answer the query through ServeDNS, as the regular UDP path would
+func serveDNSWire(t testing.TB, handler *DNSHandler, query *dns.Msg) []byte {
+	writer := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: testFastPathClient.AsSlice(), Port: 5353}}
+	handler.ServeDNS(writer, query)
+	if len(writer.messages) != 1 {
+		t.Fatalf("expected one response, got %d", len(writer.messages))
+	}
+	// Written packed or as a message, which ServeDNS compresses either way
+	writer.messages[0].Compress = true
+	response, err := writer.messages[0].Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestFastPathAnswersLikeServeDNS(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := &DNSHandler{
+		zone:      "example.com.",
+		nsA:       []net.IP{testNsA1},
+		blocklist: newTestBlocklist("10.0.0.2", "1:2:3:4:5:6:7:8"),
+		// Leaving out ::1 and 1.2.3.4
+		allowlist:      []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")},
+		allowlistRcode: dns.RcodeRefused,
+		ttls:           &[ttlClassCount]uint32{ttlClassIP: 604800},
+	}
+	reader := newTestFastPathReader(handler)
+
+	for _, name := range []string{
+		"10-0-0-1.example.com.",
+		"10.0.0.1.example.com.",
+		"app.10-0-0-1.example.com.",
+		"App.10.0.0.1.Example.COM.",
+		"2001-db8--1.example.com.",
+		"--1.example.com.",
+		"--ffff-a00-1.example.com.",
+		"2001.db8.0.0.0.0.0.1.example.com.",
+		"1.2.3.4.5.6.7.8.example.com.",
+		"1-2-3-4.example.com.",
+	} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			for _, edns := range []bool{false, true} {
+				query := new(dns.Msg).SetQuestion(name, qtype)
+				query.CheckingDisabled = true
+				if edns {
+					query.SetEdns0(4096, true)
+				}
+				wire, err := query.Pack()
+				assert.NoError(t, err)
+
+				response, handled := reader.answer(wire, testFastPathClient)
+
+				if handled {
+					assert.Equal(t, serveDNSWire(t, handler, query), response, "%s %s", name, dns.TypeToString[qtype])
+				} else {
+					// Only empty answers may be left to the regular path here
+					unpacked := new(dns.Msg)
+					assert.NoError(t, unpacked.Unpack(serveDNSWire(t, handler, query)))
+					assert.Empty(t, unpacked.Answer, "%s %s", name, dns.TypeToString[qtype])
+				}
+			}
+		}
+	}
+}
+
+func TestFastPathLeavesOtherQueriesToServeDNS(t *testing.T) {
+	handler := &DNSHandler{
+		zone:      "example.com.",
+		nsA:       []net.IP{testNsA1},
+		blocklist: newTestBlocklist("10.0.0.2"),
+	}
+	reader := newTestFastPathReader(handler)
+	withCookie := new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA)
+	withCookie.SetEdns0(4096, false)
+	withCookie.IsEdns0().Option = append(withCookie.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	withNewerEDNS := new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA)
+	withNewerEDNS.SetEdns0(4096, false)
+	withNewerEDNS.IsEdns0().SetVersion(1)
+	update := new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA)
+	update.Opcode = dns.OpcodeUpdate
+
+	for _, query := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("alpha.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeTXT),
+		new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeAAAA),
+		new(dns.Msg).SetQuestion("10-0-0-2.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("10-0-0-1example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("10-0-0-1.example.org.", dns.TypeA),
+		new(dns.Msg).SetQuestion("10_0_0_1.example.com.", dns.TypeA),
+		withCookie,
+		withNewerEDNS,
+		update,
+	} {
+		wire, err := query.Pack()
+		assert.NoError(t, err)
+
+		_, handled := reader.answer(wire, testFastPathClient)
+
+		assert.False(t, handled, query.Question[0].String())
+	}
+
+	handler.authorityNS = true
+	wire, err := new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA).Pack()
+	assert.NoError(t, err)
+
+	_, handled := reader.answer(wire, testFastPathClient)
+
+	assert.False(t, handled)
+}
+
+func TestFastPathRateLimits(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := &DNSHandler{
+		zone:        "example.com.",
+		nsA:         []net.IP{testNsA1},
+		rateLimiter: newRateLimiter(2, 2, 2),
+	}
+	reader := newTestFastPathReader(handler)
+	query := new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA)
+	query.SetEdns0(4096, false)
+	wire, err := query.Pack()
+	assert.NoError(t, err)
+
+	var responses []*dns.Msg
+	for i := 0; i < 6; i++ {
+		response, handled := reader.answer(wire, testFastPathClient)
+
+		assert.True(t, handled)
+		if response != nil {
+			unpacked := new(dns.Msg)
+			assert.NoError(t, unpacked.Unpack(response))
+			responses = append(responses, unpacked)
+		}
+	}
+
+	// Same as over the regular path: two responses fit in the bucket, then every second limited one is slipped
+	assert.Len(t, responses, 4)
+	assert.Len(t, responses[1].Answer, 1)
+	assert.True(t, responses[2].Truncated)
+	assert.Empty(t, responses[2].Answer)
+	assert.Empty(t, responses[2].Extra)
+	assert.Equal(t, query.Id, responses[2].Id)
+}
+
+func TestFastPathDoesNotAllocate(t *testing.T) {
+	handler := &DNSHandler{
+		zone:        "example.com.",
+		nsA:         []net.IP{testNsA1},
+		blocklist:   newTestBlocklist("10.0.0.2"),
+		allowlist:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")},
+		rateLimiter: newRateLimiter(1e9, 1e9, 1e9),
+	}
+	reader := newTestFastPathReader(handler)
+
+	for _, query := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("app.10.0.0.1.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("2001-db8--1.example.com.", dns.TypeAAAA).SetEdns0(4096, false),
+	} {
+		wire, err := query.Pack()
+		assert.NoError(t, err)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, handled := reader.answer(wire, testFastPathClient); !handled {
+				t.Fatal("query not handled")
+			}
+		})
+
+		assert.Zero(t, allocs, query.Question[0].String())
+	}
+}
+
+func TestParsesIPTextLikeNetParseIP(t *testing.T) {
+	for _, text := range []string{
+		"0.0.0.0", "10.0.0.1", "255.255.255.255", "256.0.0.1", "01.0.0.1", "1.0.0.00", "1.2.3", "1.2.3.4.5",
+		"1..2.3", ".1.2.3", "1.2.3.", "1.2.3.4a", "", "1234.1.1.1",
+		"::", "::1", "1::", "2001:db8::1", "1:2:3:4:5:6:7:8", "1:2:3:4:5:6:7::8", "1:2:3:4:5:6:7:8:9", "1:2:3:4:5:6:7",
+		":1:2:3:4:5:6:7", "1:2:3:4:5:6:7:", "1:::2", "1::2::3", "12345::1", "ABCD:ef::0", "::ffff:a00:1", "g::1",
+		":", ":::", "1:2", "0:0:0:0:0:0:0:0", "::1:2:3:4:5:6:7", "1:2:3:4:5:6::7",
+	} {
+		expected := net.ParseIP(text)
+
+		ipv4, ipv4OK := parseIPv4Text([]byte(text))
+		ipv6, ipv6OK := parseIPv6Text([]byte(text))
+
+		switch {
+		case expected == nil:
+			assert.False(t, ipv4OK, text)
+			assert.False(t, ipv6OK, text)
+		case expected.To4() != nil && !ipv6OK:
+			assert.True(t, ipv4OK, text)
+			assert.Equal(t, expected.To4(), net.IP(ipv4[:]), text)
+		default:
+			assert.True(t, ipv6OK, text)
+			assert.Equal(t, expected.To16(), net.IP(ipv6[:]), text)
+		}
+	}
+}
+
+func BenchmarkResolveIPDerived(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := &DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+
+	for _, query := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("2001-db8--1.example.com.", dns.TypeAAAA).SetEdns0(4096, false),
+	} {
+		wire, err := query.Pack()
+		if err != nil {
+			b.Fatal(err)
+		}
+		qtype := dns.TypeToString[query.Question[0].Qtype]
+
+		// What the server does for every query without the fast path: unpack, resolve, pack
+		b.Run(fmt.Sprintf("%s/ServeDNS", qtype), func(b *testing.B) {
+			writer := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: testFastPathClient.AsSlice(), Port: 5353}}
+			b.ReportAllocs()
+			for range b.N {
+				unpacked := new(dns.Msg)
+				if err := unpacked.Unpack(wire); err != nil {
+					b.Fatal(err)
+				}
+				handler.ServeDNS(writer, unpacked)
+				if _, err := writer.messages[0].Pack(); err != nil {
+					b.Fatal(err)
+				}
+				writer.messages = writer.messages[:0]
+			}
+		})
+
+		b.Run(fmt.Sprintf("%s/FastPath", qtype), func(b *testing.B) {
+			reader := newTestFastPathReader(handler)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, handled := reader.answer(wire, testFastPathClient); !handled {
+					b.Fatal("query not handled")
+				}
+			}
+		})
+	}
+}
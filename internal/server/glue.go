@@ -0,0 +1,78 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Fill in the authority section of negative answers with the zone's SOA for negative caching, and of positive answers
+// with the zone's NS set (if enabled), then the additional section with addresses of nameservers referenced in the
+// answer and authority sections, saving resolvers round trips
+func (h *DNSHandler) addAuthorityAndAdditional(msg *dns.Msg, qtype uint16) {
+	if msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0) {
+		soa := h.soaRR()
+		// Negative answers are cached for the lower of the SOA TTL and minimum (RFC 2308)
+		soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+		msg.Ns = []dns.RR{soa}
+	} else if h.authorityNS && msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 && qtype != dns.TypeNS {
+		msg.Ns, _ = h.resolveRRs(dns.Question{
+			Name:   h.zone,
+			Qtype:  dns.TypeNS,
+			Qclass: dns.ClassINET,
+		})
+	}
+
+	var glue []dns.RR
+	seen := make(map[string]bool)
+	for _, records := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, record := range records {
+			ns, ok := record.(*dns.NS)
+			if !ok || seen[ns.Ns] {
+				continue
+			}
+			seen[ns.Ns] = true
+			for _, addressType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				addresses, _ := h.resolveRRs(dns.Question{
+					Name:   ns.Ns,
+					Qtype:  addressType,
+					Qclass: dns.ClassINET,
+				})
+				glue = append(glue, addresses...)
+			}
+		}
+	}
+	// Keep the OPT record (if any) at the end of the additional section
+	msg.Extra = append(glue, msg.Extra...)
+}
+
+// Determine the largest response the client can receive over UDP
+func maxUDPResponseSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil {
+		return max(dns.MinMsgSize, min(int(opt.UDPSize()), ednsUDPSize))
+	}
+	return dns.MinMsgSize
+}
+
+// Fit the response into the given size, dropping the optional additional and authority records before resorting to
+// truncating the answer
+func trimResponse(msg *dns.Msg, size int) {
+	msg.Compress = true
+	for msg.Len() > size {
+		if i := lastNonOPTIndex(msg.Extra); i >= 0 {
+			msg.Extra = append(msg.Extra[:i], msg.Extra[i+1:]...)
+		} else if len(msg.Ns) > 0 {
+			msg.Ns = msg.Ns[:len(msg.Ns)-1]
+		} else {
+			msg.Truncate(size)
+			return
+		}
+	}
+}
+
+func lastNonOPTIndex(records []dns.RR) int {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Header().Rrtype != dns.TypeOPT {
+			return i
+		}
+	}
+	return -1
+}
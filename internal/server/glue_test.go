@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+var testNsAAAA1 = net.ParseIP("2001:db8::53")
+var testNsAAAA2 = net.ParseIP("2001:db8::54")
+
+func recordTypesAndNames(records []dns.RR) []string {
+	var descriptions []string
+	for _, record := range records {
+		descriptions = append(descriptions, dns.TypeToString[record.Header().Rrtype]+" "+record.Header().Name)
+	}
+	return descriptions
+}
+
+func TestServeDNSAddsGlueToNSAnswers(t *testing.T) {
+	handler := DNSHandler{
+		zone:   "example.com.",
+		nsA:    []net.IP{testNsA1, testNsA12},
+		nsAAAA: []net.IP{testNsAAAA1, testNsAAAA2},
+	}
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("example.com.", dns.TypeNS))
+
+	response := w.messages[0]
+	assert.Equal(t, []string{"NS example.com.", "NS example.com."}, recordTypesAndNames(response.Answer))
+	assert.Empty(t, response.Ns)
+	assert.Equal(t, []string{
+		"A alpha.example.com.",
+		"AAAA alpha.example.com.",
+		"A omega.example.com.",
+		"AAAA omega.example.com.",
+	}, recordTypesAndNames(response.Extra))
+	assert.Equal(t, testNsAAAA2, response.Extra[3].(*dns.AAAA).AAAA)
+}
+
+func TestServeDNSAddsAuthorityNSToPositiveAnswersIfEnabled(t *testing.T) {
+	handler := DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA))
+
+	assert.Empty(t, w.messages[0].Ns)
+	assert.Empty(t, w.messages[0].Extra)
+
+	handler.authorityNS = true
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA))
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("foo.example.com.", dns.TypeA))
+
+	assert.Equal(t, []string{"NS example.com."}, recordTypesAndNames(w.messages[1].Ns))
+	assert.Equal(t, []string{"A alpha.example.com."}, recordTypesAndNames(w.messages[1].Extra))
+	assert.Equal(t, []string{"SOA example.com."}, recordTypesAndNames(w.messages[2].Ns))
+	assert.Empty(t, w.messages[2].Extra)
+}
+
+func TestServeDNSTrimsOptionalRecordsBeforeTruncating(t *testing.T) {
+	handler := DNSHandler{
+		zone:        "example.com.",
+		nsA:         []net.IP{testNsA1, testNsA12},
+		nsAAAA:      []net.IP{testNsAAAA1, testNsAAAA2},
+		rootTXT:     []string{strings.Repeat("a", 200), strings.Repeat("b", 200)},
+		authorityNS: true,
+	}
+	udpWriter := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+
+	handler.ServeDNS(udpWriter, new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT))
+
+	response := udpWriter.messages[0]
+	packed, err := response.Pack()
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(packed), dns.MinMsgSize)
+	assert.False(t, response.Truncated)
+	assert.Len(t, response.Answer, 1)
+	assert.Len(t, response.Ns, 2)
+	assert.Less(t, len(response.Extra), 4)
+
+	handler.rootTXT = append(handler.rootTXT, strings.Repeat("c", 200))
+	handler.ServeDNS(udpWriter, new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT))
+
+	assert.True(t, udpWriter.messages[1].Truncated)
+	assert.Empty(t, udpWriter.messages[1].Answer)
+
+	// Clients advertising a larger buffer over EDNS get everything
+	handler.ServeDNS(udpWriter, new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT).SetEdns0(4096, false))
+
+	assert.False(t, udpWriter.messages[2].Truncated)
+	assert.Len(t, udpWriter.messages[2].Answer, 1)
+	assert.Len(t, udpWriter.messages[2].Extra, 5)
+
+	tcpWriter := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	handler.ServeDNS(tcpWriter, new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT))
+
+	assert.False(t, tcpWriter.messages[0].Truncated)
+	assert.Len(t, tcpWriter.messages[0].Extra, 4)
+}
@@ -1,16 +1,30 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+// Default TTL of records, unless configured otherwise for their class
 const ttl = 86400
 
+// Default TTL of negative answers, as advertised by the SOA record
+const negativeTTL = 3600
+
+// The UDP payload size advertised over EDNS, as recommended by DNS Flag Day 2020 to avoid fragmentation
+const ednsUDPSize = 1232
+
 type DNSHandler struct {
 	zone        string
 	websiteA    []net.IP
@@ -18,7 +32,49 @@ type DNSHandler struct {
 	nsA         []net.IP
 	nsAAAA      []net.IP
 	rootTXT     []string
-	blocklist   []net.IP
+	blocklist   *blocklist
+	// Prefixes that IP-derived names must be in to resolve, all if empty, and the rcode of names outside them
+	allowlist      []netip.Prefix
+	allowlistRcode int
+	rateLimiter    *rateLimiter
+	// TTLs indexed by record class, nil meaning defaults
+	ttls *[ttlClassCount]uint32
+	// Serial number of the SOA record, issued from serialPath for serving if set
+	serial     uint32
+	serialPath string
+	// Secondaries notified of zone changes
+	notifier *notifier
+	// CAA properties served at the apex, and for IP-derived names too if caaForBacknames is set
+	caa             []caaProperty
+	caaForBacknames bool
+	// Whether positive answers carry the zone's NS set in the authority section
+	authorityNS bool
+	// Whether ANY over TCP returns every record of the name, instead of the minimal RFC 8482 response
+	fullANYOverTCP bool
+	// Secrets for DNS cookies, the first one is used for new cookies and all are accepted
+	cookieSecrets [][16]byte
+	// Clients allowed to transfer the zone, besides those signing with a TSIG key
+	transferACL []netip.Prefix
+	// TSIG keys accepted for transfers and privileged queries, also verifying requests as the servers' TsigProvider
+	tsigKeys tsigKeyring
+	// Query types only answered to requests signed with a TSIG key
+	privilegedTypes map[uint16]bool
+	// Subtree of the zone where dynamic names can be created with DNS UPDATE, their records, and how long record sets
+	// live after being updated, forever if zero
+	updateSubtree string
+	records       recordStore
+	// Append-only log that the records get persisted in once opened, kept in memory only if empty
+	recordStorePath string
+	recordLifetime  time.Duration
+	updateMu        sync.Mutex
+	// Tokens of the HTTP API, through which aliases right below the zone can be created
+	apiTokens []apiToken
+	// Tokens of the admin HTTP API, through which the blocklist is managed
+	adminTokens []adminToken
+	// Secret that IP-derived names must be signed with to resolve, nil if unsigned names resolve
+	nameSecret []byte
+	// Packed responses for the static names, keyed as built by appendStaticResponseKey
+	staticResponses atomic.Pointer[map[string]staticResponse]
 }
 
 func (h *DNSHandler) InitFromEnv() {
@@ -81,22 +137,157 @@ func (h *DNSHandler) InitFromEnv() {
 	if rootTXTsRaw := os.Getenv("ROOT_TXT"); rootTXTsRaw != "" {
 		h.rootTXT = strings.Split(rootTXTsRaw, ",")
 	}
-	if blocklistIPsRaw := os.Getenv("BLOCKLIST"); blocklistIPsRaw != "" {
-		blocklistIPsSplit := strings.Split(blocklistIPsRaw, ",")
-		for _, blocklistIPRaw := range blocklistIPsSplit {
-			if blocklistIP := net.ParseIP(blocklistIPRaw); blocklistIP != nil {
-				h.blocklist = append(h.blocklist, blocklistIP)
-			} else {
-				log.Fatalf("BLOCKLIST environment variable is invalid: %s", blocklistIPRaw)
+	h.blocklist = blocklistFromEnv()
+	if allowlistRaw := os.Getenv("ALLOWLIST"); allowlistRaw != "" {
+		for _, prefixRaw := range strings.Split(allowlistRaw, ",") {
+			prefix, err := parsePrefix(prefixRaw)
+			if err != nil {
+				log.Fatalf("ALLOWLIST environment variable is invalid: %s", prefixRaw)
 			}
+			h.allowlist = append(h.allowlist, prefix)
+		}
+	}
+	h.allowlistRcode = dns.RcodeNameError
+	if allowlistRcodeRaw := os.Getenv("ALLOWLIST_RCODE"); allowlistRcodeRaw != "" {
+		switch allowlistRcode := dns.StringToRcode[strings.ToUpper(allowlistRcodeRaw)]; allowlistRcode {
+		case dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeRefused, dns.RcodeServerFailure:
+			h.allowlistRcode = allowlistRcode
+		default:
+			log.Fatalf("ALLOWLIST_RCODE environment variable is invalid: %s", allowlistRcodeRaw)
+		}
+	}
+	h.ttls = ttlsFromEnv()
+	h.caa, h.caaForBacknames = caaFromEnv()
+	if authorityNSRaw := os.Getenv("AUTHORITY_NS"); authorityNSRaw != "" {
+		authorityNS, err := strconv.ParseBool(authorityNSRaw)
+		if err != nil {
+			log.Fatalf("AUTHORITY_NS environment variable is invalid: %s", authorityNSRaw)
+		}
+		h.authorityNS = authorityNS
+	}
+	if fullANYOverTCPRaw := os.Getenv("FULL_ANY_OVER_TCP"); fullANYOverTCPRaw != "" {
+		fullANYOverTCP, err := strconv.ParseBool(fullANYOverTCPRaw)
+		if err != nil {
+			log.Fatalf("FULL_ANY_OVER_TCP environment variable is invalid: %s", fullANYOverTCPRaw)
 		}
+		h.fullANYOverTCP = fullANYOverTCP
 	}
+	h.rateLimiter = newRateLimiterFromEnv()
+	h.cookieSecrets = cookieSecretsFromEnv()
+	h.transferACL = transferACLFromEnv()
+	h.tsigKeys = tsigKeyringFromEnv()
+	h.privilegedTypes = privilegedTypesFromEnv()
+	h.notifier = newNotifierFromEnv()
+	h.updateSubtree = updateSubtreeFromEnv(h.zone)
+	h.apiTokens = apiTokensFromEnv()
+	h.adminTokens = adminTokensFromEnv()
+	h.nameSecret = nameSecretFromEnv()
+	if h.updateSubtree != "" || h.apiTokens != nil {
+		// The log itself is only opened for serving, as opening it can compact it
+		h.records = newMemoryStore()
+		h.recordStorePath = os.Getenv("RECORD_STORE")
+		if recordLifetimeRaw := os.Getenv("RECORD_LIFETIME"); recordLifetimeRaw != "" {
+			recordLifetime, err := time.ParseDuration(recordLifetimeRaw)
+			if err != nil || recordLifetime < 0 {
+				log.Fatalf("RECORD_LIFETIME environment variable is invalid: %s", recordLifetimeRaw)
+			}
+			h.recordLifetime = recordLifetime
+		}
+	}
+	h.serial, h.serialPath = h.serialFromEnv()
+	h.rebuildStaticResponses()
+}
+
+// Open the files that the handler persists state in, for serving. Only one process can have them open at a time,
+// as they get rewritten, so validating the configuration uses CheckStores instead
+func (h *DNSHandler) OpenStores() error {
+	if h.recordStorePath != "" {
+		store, err := openLogStore(h.recordStorePath)
+		if err != nil {
+			return fmt.Errorf("RECORD_STORE %s: %w", h.recordStorePath, err)
+		}
+		h.records = store
+	}
+	if h.blocklist != nil && h.blocklist.auditPath != "" {
+		if err := h.blocklist.openAuditLog(h.blocklist.auditPath); err != nil {
+			return fmt.Errorf("BLOCKLIST_AUDIT_LOG %s: %w", h.blocklist.auditPath, err)
+		}
+	}
+	if h.serialPath != "" {
+		serial, err := issueSerial(h.serialPath, h.zoneHash(), time.Now())
+		if err != nil {
+			return fmt.Errorf("SOA_SERIAL_FILE %s: %w", h.serialPath, err)
+		}
+		h.serial = serial
+		// The cached negative responses carry the SOA record
+		h.rebuildStaticResponses()
+	}
+	return nil
+}
+
+// Check that the files that the handler persists state in can be read, without writing to them
+func (h *DNSHandler) CheckStores() error {
+	if h.recordStorePath != "" {
+		if err := checkLogStore(h.recordStorePath); err != nil {
+			return fmt.Errorf("RECORD_STORE %s: %w", h.recordStorePath, err)
+		}
+	}
+	if h.blocklist != nil && h.blocklist.auditPath != "" {
+		if err := checkAuditLog(h.blocklist.auditPath); err != nil {
+			return fmt.Errorf("BLOCKLIST_AUDIT_LOG %s: %w", h.blocklist.auditPath, err)
+		}
+	}
+	if h.serialPath != "" {
+		if _, _, err := readSerialFile(h.serialPath); err != nil {
+			return fmt.Errorf("SOA_SERIAL_FILE %s: %w", h.serialPath, err)
+		}
+	}
+	return nil
+}
+
+// Prune expired blocklist entries at the interval, recording their expiry, until done is closed
+func (h *DNSHandler) PruneBlocklistEvery(interval time.Duration, done <-chan struct{}) {
+	if h.blocklist == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.blocklist.pruneExpired(); err != nil {
+				log.Printf("Failed to prune the blocklist: %v\n", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Release what the handler holds open, once it's done serving
+func (h *DNSHandler) Close() error {
+	var errs []error
+	if h.records != nil {
+		errs = append(errs, h.records.close())
+	}
+	if h.blocklist != nil {
+		errs = append(errs, h.blocklist.close())
+	}
+	return errors.Join(errs...)
 }
 
 // Resolve a question into an answer, an extra record and a response code
 func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
+	if question.Qtype == dns.TypeANY {
+		return h.ResolveANY(question, false)
+	}
+
 	log.Printf("Resolving %s records for %s\n", dns.TypeToString[question.Qtype], question.Name)
 
+	return h.resolveRRs(question)
+}
+
+func (h *DNSHandler) resolveRRs(question dns.Question) ([]dns.RR, int) {
 	if question.Qclass != dns.ClassINET {
 		return nil, dns.RcodeNotImplemented
 	}
@@ -115,10 +306,16 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 
 	if question.Qtype == dns.TypeNS { // NS records are available everywhere in the zone, even for non-existent domains
 		records = append(records, &dns.NS{
+			Hdr: dns.RR_Header{
+				Ttl: h.ttlFor(ttlClassNameserver),
+			},
 			Ns: "alpha." + h.zone,
 		})
 		if len(h.nsA) > 1 {
 			records = append(records, &dns.NS{
+				Hdr: dns.RR_Header{
+					Ttl: h.ttlFor(ttlClassNameserver),
+				},
 				Ns: "omega." + h.zone,
 			})
 		}
@@ -129,21 +326,34 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 		case dns.TypeA:
 			for _, websiteIPv4 := range h.websiteA {
 				records = append(records, &dns.A{
+					Hdr: dns.RR_Header{
+						Ttl: h.ttlFor(ttlClassWebsite),
+					},
 					A: websiteIPv4,
 				})
 			}
 		case dns.TypeAAAA:
 			for _, websiteIPv6 := range h.websiteAAAA {
 				records = append(records, &dns.AAAA{
+					Hdr: dns.RR_Header{
+						Ttl: h.ttlFor(ttlClassWebsite),
+					},
 					AAAA: websiteIPv6,
 				})
 			}
 		case dns.TypeTXT:
 			if len(h.rootTXT) > 0 {
 				records = append(records, &dns.TXT{
+					Hdr: dns.RR_Header{
+						Ttl: h.ttlFor(ttlClassTXT),
+					},
 					Txt: h.rootTXT,
 				})
 			}
+		case dns.TypeCAA:
+			records = append(records, h.caaRRs()...)
+		case dns.TypeSOA:
+			records = append(records, h.soaRR())
 		}
 	} else if subdomain == "www" { // www.<zone>
 		switch question.Qtype {
@@ -153,6 +363,9 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 				break
 			}
 			records = append(records, &dns.CNAME{
+				Hdr: dns.RR_Header{
+					Ttl: h.ttlFor(ttlClassWWW),
+				},
 				Target: h.zone,
 			})
 		case dns.TypeA:
@@ -166,6 +379,7 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 			records = append(records, &dns.CNAME{
 				Hdr: dns.RR_Header{
 					Rrtype: dns.TypeCNAME,
+					Ttl:    h.ttlFor(ttlClassWWW),
 				},
 				Target: h.zone,
 			})
@@ -173,6 +387,7 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 				records = append(records, &dns.A{
 					Hdr: dns.RR_Header{
 						Name: "www." + h.zone,
+						Ttl:  h.ttlFor(ttlClassWebsite),
 					},
 					A: websiteIPv6,
 				})
@@ -189,12 +404,14 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 				Target: h.zone,
 				Hdr: dns.RR_Header{
 					Rrtype: dns.TypeCNAME,
+					Ttl:    h.ttlFor(ttlClassWWW),
 				},
 			})
 			for _, websiteIPv4 := range h.websiteAAAA {
 				records = append(records, &dns.AAAA{
 					Hdr: dns.RR_Header{
 						Name: "www." + h.zone,
+						Ttl:  h.ttlFor(ttlClassWebsite),
 					},
 					AAAA: websiteIPv4,
 				})
@@ -204,11 +421,17 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 		switch question.Qtype {
 		case dns.TypeA:
 			records = append(records, &dns.A{
+				Hdr: dns.RR_Header{
+					Ttl: h.ttlFor(ttlClassNameserver),
+				},
 				A: h.nsA[0],
 			})
 		case dns.TypeAAAA:
 			if len(h.nsAAAA) > 0 {
 				records = append(records, &dns.AAAA{
+					Hdr: dns.RR_Header{
+						Ttl: h.ttlFor(ttlClassNameserver),
+					},
 					AAAA: h.nsAAAA[0],
 				})
 			}
@@ -218,6 +441,9 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 		case dns.TypeA:
 			if len(h.nsA) > 1 {
 				records = append(records, &dns.A{
+					Hdr: dns.RR_Header{
+						Ttl: h.ttlFor(ttlClassNameserver),
+					},
 					A: h.nsA[1],
 				})
 			} else {
@@ -226,26 +452,51 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 		case dns.TypeAAAA:
 			if len(h.nsAAAA) > 1 {
 				records = append(records, &dns.AAAA{
+					Hdr: dns.RR_Header{
+						Ttl: h.ttlFor(ttlClassNameserver),
+					},
 					AAAA: h.nsAAAA[1],
 				})
 			} else {
 				code = dns.RcodeNameError
 			}
 		}
-	} else if subdomainIPv6 := parseIPv6Subdomain(subdomain); subdomainIPv6 != nil && !h.isBlocked(subdomainIPv6) { // <ipv6>.<zone>
-		switch question.Qtype {
-		case dns.TypeAAAA:
+	} else if sets := h.lookupDynamic(question.Name); sets != nil { // <dynamic name>.<update subtree> - ahead of IPs
+		records = append(records, dynamicAnswers(sets, question)...)
+	} else if subdomainIPv6, ttl := h.parseIPv6Subdomain(subdomain); subdomainIPv6 != nil && !h.isBlocked(subdomainIPv6) { // <ipv6>.<zone>
+		switch {
+		case !h.isAllowed(subdomainIPv6): // The blocklist takes precedence, so blocked addresses don't resolve either way
+			code = h.allowlistRcode
+		case question.Qtype == dns.TypeAAAA:
 			records = append(records, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Ttl: ttl,
+				},
 				AAAA: subdomainIPv6,
 			})
+		case question.Qtype == dns.TypeCAA:
+			if h.caaForBacknames {
+				records = append(records, h.caaRRs()...)
+			}
 		}
-	} else if subdomainIPv4 := parseIPv4Subdomain(subdomain); subdomainIPv4 != nil && !h.isBlocked(subdomainIPv4) { // <ipv4>.<zone>
-		switch question.Qtype {
-		case dns.TypeA:
+	} else if subdomainIPv4, ttl := h.parseIPv4Subdomain(subdomain); subdomainIPv4 != nil && !h.isBlocked(subdomainIPv4) { // <ipv4>.<zone>
+		switch {
+		case !h.isAllowed(subdomainIPv4): // The blocklist takes precedence, so blocked addresses don't resolve either way
+			code = h.allowlistRcode
+		case question.Qtype == dns.TypeA:
 			records = append(records, &dns.A{
+				Hdr: dns.RR_Header{
+					Ttl: ttl,
+				},
 				A: subdomainIPv4,
 			})
+		case question.Qtype == dns.TypeCAA:
+			if h.caaForBacknames {
+				records = append(records, h.caaRRs()...)
+			}
 		}
+	} else if sets := h.lookupAlias(question.Name); sets != nil { // <alias>.<zone> - created through the HTTP API
+		records = append(records, dynamicAnswers(sets, question)...)
 	} else {
 		code = dns.RcodeNameError
 	}
@@ -268,40 +519,218 @@ func (h *DNSHandler) ResolveRRs(question dns.Question) ([]dns.RR, int) {
 				header.Rrtype = dns.TypeNS
 			case dns.TypeTXT:
 				header.Rrtype = dns.TypeTXT
+			case dns.TypeCAA:
+				header.Rrtype = dns.TypeCAA
+			case dns.TypeSOA:
+				header.Rrtype = dns.TypeSOA
 			}
 		}
 		header.Class = dns.ClassINET
-		header.Ttl = ttl
 	}
 
 	return records, code
 }
 
-func (h *DNSHandler) isBlocked(ip net.IP) bool {
-	for _, blocklistIP := range h.blocklist {
-		if blocklistIP.Equal(ip) {
+func (h *DNSHandler) isAllowed(ip net.IP) bool {
+	if len(h.allowlist) == 0 {
+		return true
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	addr = addr.Unmap()
+	for _, prefix := range h.allowlist {
+		if prefix.Contains(addr) {
 			return true
 		}
 	}
 	return false
 }
 
+func (h *DNSHandler) isBlocked(ip net.IP) bool {
+	_, blocked := h.blockingEntry(ip)
+	return blocked
+}
+
+// Blocklist entry of the address that applies now, if any
+func (h *DNSHandler) blockingEntry(ip net.IP) (blocklistEntry, bool) {
+	if h.blocklist == nil {
+		return blocklistEntry{}, false
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return h.blocklist.lookup(addr.Unmap(), time.Now())
+}
+
 func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	msg := new(dns.Msg)
 	msg.SetReply(r)
 	msg.Authoritative = true
 
+	// Nothing is answered to a request whose signature doesn't verify
+	if r.IsTsig() != nil && w.TsigStatus() != nil {
+		h.writeTsigError(w, r, w.TsigStatus())
+		return
+	}
+
+	cookieStatus := cookieMissing
+	if requestOPT := r.IsEdns0(); requestOPT != nil {
+		responseOPT := &dns.OPT{
+			Hdr: dns.RR_Header{
+				Name:   ".",
+				Rrtype: dns.TypeOPT,
+			},
+		}
+		responseOPT.SetUDPSize(ednsUDPSize)
+		msg.Extra = append(msg.Extra, responseOPT)
+
+		// Only EDNS version 0 exists so far
+		if requestOPT.Version() != 0 {
+			msg.Rcode = dns.RcodeBadVers
+			h.writeResponse(w, r, msg, cookieStatus)
+			return
+		}
+
+		cookieStatus = h.processCookie(requestOPT, responseOPT, remoteIP(w))
+		if cookieStatus == cookieMalformed {
+			msg.SetRcode(r, dns.RcodeFormatError)
+			h.writeResponse(w, r, msg, cookieStatus)
+			return
+		}
+	}
+
+	if r.Opcode == dns.OpcodeUpdate {
+		msg.SetRcode(r, h.resolveUpdate(w, r))
+		switch msg.Rcode {
+		case dns.RcodeNotImplemented:
+			addExtendedError(msg, dns.ExtendedErrorCodeNotSupported, "dynamic updates are disabled")
+		case dns.RcodeRefused:
+			addExtendedError(msg, dns.ExtendedErrorCodeProhibited, "")
+		}
+		h.writeResponse(w, r, msg, cookieStatus)
+		return
+	}
+
 	// Refuse if there are multiple question resource records
 	if len(r.Question) != 1 {
 		msg.SetRcode(r, dns.RcodeRefused)
-		w.WriteMsg(msg)
+		addExtendedError(msg, dns.ExtendedErrorCodeNotSupported, "exactly one question is answered")
+		h.writeResponse(w, r, msg, cookieStatus)
 		return
 	}
 
 	question := r.Question[0]
-	answers, rcode := h.ResolveRRs(question)
+	if question.Qtype == dns.TypeAXFR || question.Qtype == dns.TypeIXFR {
+		answers, rcode := h.resolveTransfer(w, r, question)
+		msg.Answer = append(msg.Answer, answers...)
+		msg.SetRcode(r, rcode)
+		switch rcode {
+		case dns.RcodeNotAuth:
+			addExtendedError(msg, dns.ExtendedErrorCodeNotAuthoritative, "only "+h.zone+" can be transferred")
+		case dns.RcodeRefused:
+			addExtendedError(msg, dns.ExtendedErrorCodeProhibited, "")
+		}
+		h.writeResponse(w, r, msg, cookieStatus)
+		return
+	}
+
+	signed := isTsigValid(w, r)
+	if h.privilegedTypes[question.Qtype] && !signed {
+		log.Printf("Refused unsigned %s query from %s\n", dns.TypeToString[question.Qtype], w.RemoteAddr())
+		msg.SetRcode(r, dns.RcodeRefused)
+		addExtendedError(msg, dns.ExtendedErrorCodeProhibited, "query type requires a TSIG signature")
+		h.writeResponse(w, r, msg, cookieStatus)
+		return
+	}
+
+	// Static names are answered from the packed responses, as on the fast path
+	if !signed && cookieStatus == cookieMissing && h.writeStaticResponse(w, r) {
+		return
+	}
+
+	var answers []dns.RR
+	var rcode int
+	if question.Qtype == dns.TypeANY {
+		_, overTCP := w.RemoteAddr().(*net.TCPAddr)
+		answers, rcode = h.ResolveANY(question, overTCP)
+	} else {
+		answers, rcode = h.ResolveRRs(question)
+	}
 	msg.Answer = append(msg.Answer, answers...)
 	msg.SetRcode(r, rcode)
+	if len(answers) == 0 {
+		if infoCode, extraText, ok := h.explainEmptyAnswer(question, rcode); ok {
+			addExtendedError(msg, infoCode, extraText)
+		}
+	}
+	h.addAuthorityAndAdditional(msg, question.Qtype)
+	if !signed {
+		// Privileged records can still come up in ANY responses, and as authority or additional records
+		msg.Answer = h.withoutPrivilegedTypes(msg.Answer)
+		msg.Ns = h.withoutPrivilegedTypes(msg.Ns)
+		msg.Extra = h.withoutPrivilegedTypes(msg.Extra)
+	}
+
+	if _, overUDP := w.RemoteAddr().(*net.UDPAddr); overUDP {
+		trimResponse(msg, maxUDPResponseSize(r))
+		if tsigSize := tsigLen(w, r); tsigSize > 0 && msg.Len()+tsigSize > maxUDPResponseSize(r) {
+			truncateForTsig(msg)
+		}
+	}
 
+	h.writeResponse(w, r, msg, cookieStatus)
+}
+
+// Write the response, signed if the request was, unless response rate limiting decides it should be dropped or
+// slipped
+func (h *DNSHandler) writeResponse(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg, cookieStatus int) {
+	if isTsigValid(w, r) {
+		// Signed requests can't be spoofed, so they aren't rate limited
+		signResponse(r, msg)
+		w.WriteMsg(msg)
+		return
+	}
+	switch h.rateLimit(w, r, msg.Rcode, cookieStatus) {
+	case rrlActionDrop:
+		return
+	case rrlActionSlip:
+		slipped := new(dns.Msg)
+		slipped.MsgHdr = msg.MsgHdr
+		slipped.Question = msg.Question
+		if cookieStatus == cookieMissing {
+			// A truncated empty response makes legitimate clients retry over TCP
+			slipped.Truncated = true
+		} else {
+			// BADCOOKIE makes legitimate clients retry with the fresh server cookie, which bypasses rate limiting
+			slipped.Rcode = dns.RcodeBadCookie
+			slipped.Extra = []dns.RR{msg.IsEdns0()}
+		}
+		msg = slipped
+	}
 	w.WriteMsg(msg)
 }
+
+// Decide what to do with an unsigned response. Only UDP gets rate limited, as TCP clients can't be spoofed, and
+// neither can clients with a valid server cookie
+func (h *DNSHandler) rateLimit(w dns.ResponseWriter, r *dns.Msg, rcode int, cookieStatus int) int {
+	if h.rateLimiter != nil && cookieStatus != cookieValid {
+		if client, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			clientAddr, _ := netip.AddrFromSlice(client.IP)
+			var qtype uint16
+			var name []byte
+			if len(r.Question) > 0 {
+				qtype, name = r.Question[0].Qtype, []byte(strings.ToLower(r.Question[0].Name))
+			}
+			return h.rateLimiter.check(clientAddr, rrlCategoryForRcode(rcode), qtype, name)
+		}
+	}
+	return rrlActionAllow
+}
+
+// Determine the address of the client, if known
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"net"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -437,10 +439,9 @@ func TestResolvesCorrectIPv4SubdomainWithDashesNamed(t *testing.T) {
 
 func TestDoesNotResolveBlockedIPv4Subdomain(t *testing.T) {
 	handler := DNSHandler{
-		zone: "example.com.",
-		nsA:  []net.IP{testNsA1},
-		blocklist: []net.IP{
-			net.ParseIP("200.0.0.4")},
+		zone:      "example.com.",
+		nsA:       []net.IP{testNsA1},
+		blocklist: newTestBlocklist("200.0.0.4"),
 	}
 
 	// foo.123-0-0-4.example.com
@@ -464,6 +465,39 @@ func TestDoesNotResolveBlockedIPv4Subdomain(t *testing.T) {
 	assert.Equal(t, []dns.RR(nil), answers_aaaa)
 }
 
+func TestResolvesOnlyAllowlistedSubdomains(t *testing.T) {
+	handler := DNSHandler{
+		zone:           "example.com.",
+		nsA:            []net.IP{testNsA1},
+		blocklist:      newTestBlocklist("10.20.0.4"),
+		allowlist:      []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16"), netip.MustParsePrefix("2001:db8:1::/48")},
+		allowlistRcode: dns.RcodeRefused,
+	}
+
+	for name, qtype := range map[string]uint16{
+		"10-20-0-1.example.com.":       dns.TypeA,
+		"foo.10.20.255.1.example.com.": dns.TypeA,
+		"2001-db8-1--1.example.com.":   dns.TypeAAAA,
+	} {
+		answers, rcode := handler.ResolveRRs(dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+
+		assert.Equal(t, dns.RcodeSuccess, rcode, name)
+		assert.Len(t, answers, 1, name)
+	}
+
+	for _, name := range []string{"10-21-0-1.example.com.", "2001-db8-2--1.example.com.", "--ffff-a00-1.example.com."} {
+		answers, rcode := handler.ResolveRRs(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+		assert.Equal(t, dns.RcodeRefused, rcode, name)
+		assert.Empty(t, answers, name)
+	}
+
+	// The blocklist takes precedence over the allowlist
+	_, rcode := handler.ResolveRRs(dns.Question{Name: "10-20-0-4.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	assert.Equal(t, dns.RcodeNameError, rcode)
+}
+
 func TestResolvesCorrectIPv6SubdomainWithDots(t *testing.T) {
 	handler := DNSHandler{
 		zone: "example.com.",
@@ -658,3 +692,68 @@ func TestResolvesTXTWithConfiguration(t *testing.T) {
 		},
 	}, answers_txt)
 }
+
+// Records messages written by the handler, as if sent to the given client
+type testResponseWriter struct {
+	remoteAddr net.Addr
+	messages   []*dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.messages = append(w.messages, m)
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.messages = append(w.messages, m)
+	return len(b), nil
+}
+
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+func TestServeDNSRateLimitsUDPClients(t *testing.T) {
+	limiter := newRateLimiter(2, 2, 2)
+	now := time.Unix(1700000000, 0)
+	limiter.now = func() time.Time { return now }
+	handler := DNSHandler{
+		zone:        "example.com.",
+		nsA:         []net.IP{testNsA1},
+		rateLimiter: limiter,
+	}
+	query := new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA)
+
+	udpWriter := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	for i := 0; i < 6; i++ {
+		handler.ServeDNS(udpWriter, query)
+	}
+
+	// Two responses fit in the bucket, then every second limited one is slipped
+	assert.Len(t, udpWriter.messages, 4)
+	assert.False(t, udpWriter.messages[1].Truncated)
+	assert.Len(t, udpWriter.messages[1].Answer, 1)
+	assert.True(t, udpWriter.messages[2].Truncated)
+	assert.Empty(t, udpWriter.messages[2].Answer)
+	assert.Equal(t, query.Id, udpWriter.messages[2].Id)
+
+	tcpWriter := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	for i := 0; i < 6; i++ {
+		handler.ServeDNS(tcpWriter, query)
+	}
+
+	assert.Len(t, tcpWriter.messages, 6)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Tracks whether the process is ready to serve DNS, for the readiness check
+type Readiness struct {
+	handler        *DNSHandler
+	listenersBound atomic.Bool
+}
+
+func NewReadiness(handler *DNSHandler) *Readiness {
+	return &Readiness{handler: handler}
+}
+
+// Record whether all DNS listeners have their sockets bound, which stops being the case once shutdown starts
+func (r *Readiness) SetListenersBound(bound bool) {
+	r.listenersBound.Store(bound)
+}
+
+// Check that the configuration is loaded, the listeners are bound, and a self-query for alpha.<zone> returns the
+// expected glue, returning the reason if not
+func (r *Readiness) Check() error {
+	if r.handler.zone == "" || len(r.handler.nsA) == 0 {
+		return errors.New("configuration not loaded")
+	}
+	if !r.listenersBound.Load() {
+		return errors.New("DNS listeners not bound")
+	}
+
+	// Resolved internally, so that the self-query isn't logged, rate limited, or refused if A is a privileged type
+	answers, rcode := r.handler.resolveRRs(dns.Question{Name: "alpha." + r.handler.zone, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if rcode != dns.RcodeSuccess {
+		return fmt.Errorf("self-query got %s", dns.RcodeToString[rcode])
+	}
+	for _, answer := range answers {
+		if a, ok := answer.(*dns.A); ok && a.A.Equal(r.handler.nsA[0]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("self-query did not return %s for alpha.%s", r.handler.nsA[0], r.handler.zone)
+}
+
+// Build the HTTP handler serving /healthz, which only reports that the process is alive, and /readyz
+func NewHTTPHandler(readiness *Readiness) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := readiness.Check(); err != nil {
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	return mux
+}
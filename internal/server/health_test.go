@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportsHealthy(t *testing.T) {
+	mux := NewHTTPHandler(NewReadiness(new(DNSHandler)))
+	recorder := httptest.NewRecorder()
+
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "ok\n", recorder.Body.String())
+}
+
+func TestReportsReadyOnlyOnceListenersAreBound(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	readiness := NewReadiness(&DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	})
+	mux := NewHTTPHandler(readiness)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "not ready: DNS listeners not bound\n", recorder.Body.String())
+
+	readiness.SetListenersBound(true)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "ready\n", recorder.Body.String())
+}
+
+func TestReportsNotReadyWithoutConfiguration(t *testing.T) {
+	readiness := NewReadiness(new(DNSHandler))
+	readiness.SetListenersBound(true)
+
+	assert.EqualError(t, readiness.Check(), "configuration not loaded")
+}
+
+func TestSelfQueryIsNotRateLimited(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	readiness := NewReadiness(&DNSHandler{
+		zone:        "example.com.",
+		nsA:         []net.IP{testNsA1},
+		rateLimiter: newRateLimiter(1, 1, 1),
+	})
+	readiness.SetListenersBound(true)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, readiness.Check())
+	}
+}
+
+func TestSelfQueryIsNotLoggedOrRefused(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	readiness := NewReadiness(&DNSHandler{
+		zone:            "example.com.",
+		nsA:             []net.IP{testNsA1},
+		privilegedTypes: map[uint16]bool{dns.TypeA: true},
+	})
+	readiness.SetListenersBound(true)
+
+	assert.NoError(t, readiness.Check())
+	assert.Empty(t, logs.String())
+}
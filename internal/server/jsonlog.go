@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Append-only log of JSON lines, each synced as it's written, so that a line is either durable or torn by a crash
+// mid-write, in which case it's dropped when the log is next opened. Callers serialize access
+type jsonLog struct {
+	path string
+	file *os.File
+	// Size of the log, up to the end of the last complete line
+	offset int64
+}
+
+// Open the log at the path for appending, creating it if needed, after passing every complete line to apply
+func openJSONLog[T any](path string, apply func(T) error) (*jsonLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	offset, torn, err := replayJSONLog(file, apply)
+	if err == nil && torn {
+		log.Printf("Dropping torn line at the end of %s\n", path)
+		err = file.Truncate(offset)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &jsonLog{path: path, file: file, offset: offset}, nil
+}
+
+// Check that every line of the log at the path can be applied, without writing to it, so that a server using it isn't
+// disturbed. A log that doesn't exist yet is fine
+func checkJSONLog[T any](path string, apply func(T) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, _, err = replayJSONLog(file, apply)
+	return err
+}
+
+// Pass every complete line of the log to apply, returning the size of the log up to the end of the last one, and
+// whether a line torn by a crash mid-write follows
+func replayJSONLog[T any](file *os.File, apply func(T) error) (int64, bool, error) {
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return offset, len(line) > 0, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		var value T
+		if err := json.Unmarshal(line, &value); err != nil {
+			return 0, false, fmt.Errorf("line at offset %d is corrupted: %w", offset, err)
+		}
+		if err := apply(value); err != nil {
+			return 0, false, fmt.Errorf("line at offset %d is corrupted: %w", offset, err)
+		}
+		offset += int64(len(line))
+	}
+}
+
+// Write the value as a line and sync it, cutting it back off if that fails, so that it's either durable or gone
+func (l *jsonLog) append(value any) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := l.file.Write(line); err != nil {
+		l.file.Truncate(l.offset)
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.file.Truncate(l.offset)
+		return err
+	}
+	l.offset += int64(len(line))
+	return nil
+}
+
+// Replace the log with the given lines, e.g. a snapshot of what the lines so far add up to
+func (l *jsonLog) rewrite(lines []byte) error {
+	if err := replaceFileSynced(l.path, lines); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.offset = int64(len(lines))
+	return nil
+}
+
+func (l *jsonLog) close() error {
+	return l.file.Close()
+}
+
+// Replace the file at the path with the data, written beside it then renamed over it, so that a crash leaves either
+// the old or the new contents
+func replaceFileSynced(path string, data []byte) error {
+	temporaryPath := path + ".tmp"
+	if err := writeFileSynced(temporaryPath, data); err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	if err := os.Rename(temporaryPath, path); err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	// The rename itself only survives a crash once the directory is synced
+	if directory, err := os.Open(filepath.Dir(path)); err == nil {
+		directory.Sync()
+		directory.Close()
+	}
+	return nil
+}
+
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Listeners used when LISTEN is unset, same as ever
+const defaultListeners = "udp://:53"
+
+// A transport and address to serve DNS on, with optional per-listener settings
+type Listener struct {
+	Net  string
+	Addr string
+	// Size of the buffer for incoming UDP messages
+	UDPSize      int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Number of sockets sharing the address with SO_REUSEPORT, each served by its own server
+	Sockets int
+	// Whether plain A and AAAA lookups of IP-derived names and queries for static names are answered straight from
+	// the wire format (UDP only, by default unless listening on a wildcard address)
+	FastPath bool
+}
+
+// Parse the comma-separated LISTEN environment variable into listeners
+func ListenersFromEnv() []Listener {
+	listenersRaw := os.Getenv("LISTEN")
+	if listenersRaw == "" {
+		listenersRaw = defaultListeners
+	}
+	var listeners []Listener
+	for _, listenerRaw := range strings.Split(listenersRaw, ",") {
+		listener, err := ParseListener(listenerRaw)
+		if err != nil {
+			log.Fatalf("LISTEN environment variable is invalid: %s (%v)", listenerRaw, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// Parse a listener written as <transport>://<address>[?<setting>=<value>&...], e.g. udp://203.0.113.1:53?udp_size=4096
+func ParseListener(listenerRaw string) (Listener, error) {
+	listenerURL, err := url.Parse(strings.TrimSpace(listenerRaw))
+	if err != nil {
+		return Listener{}, err
+	}
+	listener := Listener{
+		Net:     listenerURL.Scheme,
+		Addr:    listenerURL.Host,
+		UDPSize: dns.MaxMsgSize,
+		Sockets: 1,
+	}
+	switch listener.Net {
+	case "udp":
+		// By default, spread UDP reads over one socket per core, where they can share the address
+		if reusePortSupported {
+			listener.Sockets = runtime.NumCPU()
+		}
+	case "tcp":
+	default:
+		return Listener{}, fmt.Errorf("transport must be udp or tcp")
+	}
+	host, _, err := net.SplitHostPort(listener.Addr)
+	if err != nil {
+		return Listener{}, err
+	}
+	// The fast path replies from whatever source address the system picks, which on a wildcard address of a
+	// multi-homed host can differ from the address queried, so there it's left to miekg/dns, which replies from the
+	// address each query came to
+	listener.FastPath = listener.Net == "udp" && !isWildcardHost(host)
+	if listenerURL.Path != "" || listenerURL.User != nil || listenerURL.Fragment != "" {
+		return Listener{}, fmt.Errorf("only a transport, address and settings are allowed")
+	}
+	for setting, values := range listenerURL.Query() {
+		value := values[len(values)-1]
+		switch setting {
+		case "udp_size":
+			if listener.UDPSize, err = strconv.Atoi(value); err != nil || listener.UDPSize < dns.MinMsgSize || listener.UDPSize > dns.MaxMsgSize {
+				return Listener{}, fmt.Errorf("udp_size must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+			}
+		case "read_timeout":
+			if listener.ReadTimeout, err = time.ParseDuration(value); err != nil || listener.ReadTimeout <= 0 {
+				return Listener{}, fmt.Errorf("read_timeout must be a positive duration")
+			}
+		case "write_timeout":
+			if listener.WriteTimeout, err = time.ParseDuration(value); err != nil || listener.WriteTimeout <= 0 {
+				return Listener{}, fmt.Errorf("write_timeout must be a positive duration")
+			}
+		case "sockets":
+			if listener.Sockets, err = strconv.Atoi(value); err != nil || listener.Sockets < 1 {
+				return Listener{}, fmt.Errorf("sockets must be a positive number")
+			}
+			if listener.Sockets > 1 && !reusePortSupported {
+				return Listener{}, fmt.Errorf("multiple sockets require SO_REUSEPORT, which is not supported on this system")
+			}
+		case "fast_path":
+			if listener.FastPath, err = strconv.ParseBool(value); err != nil || listener.FastPath && listener.Net != "udp" {
+				return Listener{}, fmt.Errorf("fast_path must be true or false, and can only be enabled for udp")
+			}
+		default:
+			return Listener{}, fmt.Errorf("unknown setting %s", setting)
+		}
+	}
+	return listener, nil
+}
+
+// Check whether the host of a listener address is a wildcard, listening on every address of the system
+func isWildcardHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsUnspecified()
+}
+
+func (l Listener) String() string {
+	return l.Net + "://" + l.Addr
+}
+
+// Open the listener's sockets and create a DNS server for each of them, all serving with the handler
+func (l Listener) Servers(handler *DNSHandler) ([]*dns.Server, error) {
+	config := net.ListenConfig{Control: reusePortControl}
+	addr := l.Addr
+	servers := make([]*dns.Server, 0, l.Sockets)
+	for range l.Sockets {
+		server := &dns.Server{
+			Net:          l.Net,
+			Handler:      handler,
+			UDPSize:      l.UDPSize,
+			ReadTimeout:  l.ReadTimeout,
+			WriteTimeout: l.WriteTimeout,
+			// Always set, even without keys, so that every TSIG gets verified
+			TsigProvider:  handler.tsigKeys,
+			MsgAcceptFunc: acceptMsg,
+		}
+		var localAddr net.Addr
+		if l.Net == "udp" {
+			conn, err := config.ListenPacket(context.Background(), l.Net, addr)
+			if err != nil {
+				closeServerSockets(servers)
+				return nil, err
+			}
+			server.PacketConn = conn
+			if udpConn, ok := conn.(*net.UDPConn); ok && l.FastPath {
+				server.PacketConn = fastPathConn{udpConn}
+				server.DecorateReader = func(reader dns.Reader) dns.Reader {
+					return newFastPathReader(reader, handler, l.UDPSize)
+				}
+			}
+			localAddr = conn.LocalAddr()
+		} else {
+			listener, err := config.Listen(context.Background(), l.Net, addr)
+			if err != nil {
+				closeServerSockets(servers)
+				return nil, err
+			}
+			server.Listener = listener
+			localAddr = listener.Addr()
+		}
+		server.Addr = localAddr.String()
+		servers = append(servers, server)
+
+		// If the port is to be picked by the system, all further sockets must share the one picked for the first
+		if host, port, _ := net.SplitHostPort(addr); port == "0" {
+			_, localPort, _ := net.SplitHostPort(localAddr.String())
+			addr = net.JoinHostPort(host, localPort)
+		}
+	}
+	return servers, nil
+}
+
+func closeServerSockets(servers []*dns.Server) {
+	for _, server := range servers {
+		if server.PacketConn != nil {
+			server.PacketConn.Close()
+		}
+		if server.Listener != nil {
+			server.Listener.Close()
+		}
+	}
+}
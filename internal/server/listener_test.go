@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsesListeners(t *testing.T) {
+	// One socket per core by default, where they can share the address
+	defaultSockets := 1
+	if reusePortSupported {
+		defaultSockets = runtime.NumCPU()
+	}
+
+	listener, err := ParseListener("udp://203.0.113.1:53")
+
+	assert.NoError(t, err)
+	assert.Equal(t, Listener{Net: "udp", Addr: "203.0.113.1:53", UDPSize: dns.MaxMsgSize, Sockets: defaultSockets, FastPath: true}, listener)
+	assert.Equal(t, "udp://203.0.113.1:53", listener.String())
+
+	listener, err = ParseListener(" tcp://[2001:db8::53]:5353?read_timeout=3s&write_timeout=1s ")
+
+	assert.NoError(t, err)
+	assert.Equal(t, Listener{
+		Net:          "tcp",
+		Addr:         "[2001:db8::53]:5353",
+		UDPSize:      dns.MaxMsgSize,
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: time.Second,
+		Sockets:      1,
+	}, listener)
+
+	listener, err = ParseListener("udp://:53?udp_size=1232&sockets=3&fast_path=false")
+
+	if reusePortSupported {
+		assert.NoError(t, err)
+		assert.Equal(t, 1232, listener.UDPSize)
+		assert.Equal(t, 3, listener.Sockets)
+		assert.False(t, listener.FastPath)
+	} else {
+		assert.ErrorContains(t, err, "SO_REUSEPORT")
+	}
+
+	// Wildcard addresses only get the fast path if asked for
+	for _, listenerRaw := range []string{"udp://:53", "udp://0.0.0.0:53", "udp://[::]:53"} {
+		listener, err = ParseListener(listenerRaw)
+
+		assert.NoError(t, err)
+		assert.False(t, listener.FastPath, listenerRaw)
+	}
+	listener, err = ParseListener("udp://:53?fast_path=true")
+
+	assert.NoError(t, err)
+	assert.True(t, listener.FastPath)
+}
+
+func TestKeepsDestinationAddressesOnWildcardListeners(t *testing.T) {
+	handler := &DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+	listener, err := ParseListener("udp://0.0.0.0:0?sockets=1")
+	assert.NoError(t, err)
+
+	servers, err := listener.Servers(handler)
+
+	assert.NoError(t, err)
+	// miekg/dns only reads the destination address of each query, to reply from it, off a bare *net.UDPConn
+	assert.IsType(t, &net.UDPConn{}, servers[0].PacketConn)
+	assert.Nil(t, servers[0].DecorateReader)
+	closeServerSockets(servers)
+
+	addr := startTestServers(t, handler, listener)
+	_, port, _ := net.SplitHostPort(addr)
+	reply, err := dns.Exchange(new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA), net.JoinHostPort("127.0.0.1", port))
+
+	assert.NoError(t, err)
+	assert.Len(t, reply.Answer, 1)
+}
+
+func TestRejectsInvalidListeners(t *testing.T) {
+	for _, listenerRaw := range []string{
+		":53",
+		"http://:53",
+		"udp://127.0.0.1",
+		"udp://:53/foo",
+		"udp://:53?udp_size=100",
+		"udp://:53?read_timeout=soon",
+		"udp://:53?foo=bar",
+		"udp://:53?sockets=0",
+		"udp://:53?fast_path=maybe",
+		"tcp://:53?fast_path=true",
+	} {
+		_, err := ParseListener(listenerRaw)
+
+		assert.Error(t, err, listenerRaw)
+	}
+}
+
+func startTestServers(t testing.TB, handler *DNSHandler, listener Listener) string {
+	servers, err := listener.Servers(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range servers {
+		go server.ActivateAndServe()
+	}
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	})
+	return servers[0].Addr
+}
+
+func TestServesOnSocketsSharingPort(t *testing.T) {
+	handler := &DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+	listener, err := ParseListener("udp://127.0.0.1:0?sockets=4")
+	assert.NoError(t, err)
+
+	servers, err := listener.Servers(handler)
+
+	assert.NoError(t, err)
+	assert.Len(t, servers, 4)
+	for _, server := range servers[1:] {
+		assert.Equal(t, servers[0].Addr, server.Addr)
+	}
+	closeServerSockets(servers)
+
+	addr := startTestServers(t, handler, listener)
+	for i := 0; i < 8; i++ {
+		reply, err := dns.Exchange(new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA), addr)
+
+		assert.NoError(t, err)
+		assert.Len(t, reply.Answer, 1)
+	}
+
+	// Anything the fast path doesn't answer itself still goes through ServeDNS
+	reply, err := dns.Exchange(new(dns.Msg).SetQuestion("alpha.example.com.", dns.TypeA), addr)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "alpha.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl, Rdlength: 4},
+		A:   testNsA1.To4(),
+	}}, reply.Answer)
+}
+
+// Shows how UDP throughput scales with the number of sockets sharing the port, with queries from many source ports
+func BenchmarkUDPSockets(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := &DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+
+	for _, sockets := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			addr := startTestServers(b, handler, Listener{Net: "udp", Addr: "127.0.0.1:0", UDPSize: dns.MaxMsgSize, Sockets: sockets})
+			query := new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA)
+
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := dns.Dial("udp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+				for pb.Next() {
+					if err := conn.WriteMsg(query); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := conn.ReadMsg(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
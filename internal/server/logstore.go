@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How many superseded record set changes the log can hold before it gets compacted, on top of one per live set
+const logStoreCompactionSlack = 1024
+
+// Batch of changes as written to the log, a line of JSON each, so that a batch is either fully written or torn
+type logEntry struct {
+	Changes []logChange `json:"changes"`
+}
+
+type logChange struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Records in presentation format, none deleting the record set
+	Records []string `json:"records,omitempty"`
+	// Unix time at which the record set expires, never if zero
+	Expires int64 `json:"expires,omitempty"`
+	// Identifier of the API token owning the record set, if any
+	Owner string `json:"owner,omitempty"`
+}
+
+// Record store persisted as an append-only log of change batches, which is replayed into memory on open and compacted
+// into a snapshot of the live record sets once mostly made of superseded changes
+type logStore struct {
+	memoryStore
+	journal *jsonLog
+	// Record set changes in the log, live or superseded
+	logged int
+}
+
+func openLogStore(path string) (*logStore, error) {
+	s := &logStore{memoryStore: memoryStore{names: make(map[string]map[uint16]storedRecordSet)}}
+	journal, err := openJSONLog(path, s.replay)
+	if err != nil {
+		return nil, err
+	}
+	s.journal = journal
+	if err := s.compact(); err != nil {
+		s.journal.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Check that the log at the path can be replayed, without writing to it, so that a server using it isn't disturbed
+func checkLogStore(path string) error {
+	s := &logStore{memoryStore: memoryStore{names: make(map[string]map[uint16]storedRecordSet)}}
+	return checkJSONLog(path, s.replay)
+}
+
+// Apply a batch of the log
+func (s *logStore) replay(entry logEntry) error {
+	changes, err := decodeLogChanges(entry.Changes)
+	if err != nil {
+		return err
+	}
+	s.apply(changes)
+	s.logged += len(changes)
+	return nil
+}
+
+func (s *logStore) update(changes []recordChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.journal.append(logEntry{Changes: encodeLogChanges(changes)}); err != nil {
+		return err
+	}
+	s.apply(changes)
+	s.deleteExpired(time.Now())
+	s.logged += len(changes)
+	if s.logged > 2*s.size()+logStoreCompactionSlack {
+		// The changes are already durable, so a failed compaction only leaves the log longer than it could be
+		if err := s.compact(); err != nil {
+			log.Printf("Failed to compact %s: %v\n", s.journal.path, err)
+		}
+	}
+	return nil
+}
+
+// Replace the log with a snapshot of the live record sets, a batch per name. The lock must be held, or the store not
+// shared yet
+func (s *logStore) compact() error {
+	s.deleteExpired(time.Now())
+	var snapshot bytes.Buffer
+	for name, sets := range s.names {
+		changes := make([]recordChange, 0, len(sets))
+		for rrtype, set := range sets {
+			changes = append(changes, recordChange{name: name, rrtype: rrtype, records: set.records, expires: set.expires, owner: set.owner})
+		}
+		line, err := json.Marshal(logEntry{Changes: encodeLogChanges(changes)})
+		if err != nil {
+			return err
+		}
+		snapshot.Write(append(line, '\n'))
+	}
+	if err := s.journal.rewrite(snapshot.Bytes()); err != nil {
+		return err
+	}
+	s.logged = s.size()
+	return nil
+}
+
+func (s *logStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.journal.close()
+}
+
+func encodeLogChanges(changes []recordChange) []logChange {
+	encoded := make([]logChange, len(changes))
+	for i, change := range changes {
+		encoded[i] = logChange{Name: change.name, Type: dns.TypeToString[change.rrtype], Owner: change.owner}
+		for _, record := range change.records {
+			encoded[i].Records = append(encoded[i].Records, record.String())
+		}
+		if !change.expires.IsZero() {
+			encoded[i].Expires = change.expires.Unix()
+		}
+	}
+	return encoded
+}
+
+func decodeLogChanges(encoded []logChange) ([]recordChange, error) {
+	changes := make([]recordChange, len(encoded))
+	for i, change := range encoded {
+		rrtype, ok := dns.StringToType[change.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %s", change.Type)
+		}
+		changes[i] = recordChange{name: change.Name, rrtype: rrtype, owner: change.Owner}
+		for _, recordRaw := range change.Records {
+			record, err := dns.NewRR(recordRaw)
+			if err != nil {
+				return nil, err
+			}
+			changes[i].records = append(changes[i].records, record)
+		}
+		if change.Expires != 0 {
+			changes[i].expires = time.Unix(change.Expires, 0)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Sends NOTIFY messages (RFC 1996) to secondaries, so that they transfer the zone right after it changes
+type notifier struct {
+	secondaries []string
+	// Attempts per secondary, with the delay doubling after each unanswered one
+	attempts     int
+	initialDelay time.Duration
+	timeout      time.Duration
+}
+
+// Build a notifier for the secondaries in the NOTIFY environment variable, or return nil if there are none
+func newNotifierFromEnv() *notifier {
+	secondariesRaw := os.Getenv("NOTIFY")
+	if secondariesRaw == "" {
+		return nil
+	}
+	n := &notifier{attempts: 5, initialDelay: time.Second, timeout: 2 * time.Second}
+	for _, secondary := range strings.Split(secondariesRaw, ",") {
+		if _, _, err := net.SplitHostPort(secondary); err != nil {
+			secondary = net.JoinHostPort(secondary, "53")
+		}
+		if _, _, err := net.SplitHostPort(secondary); err != nil {
+			log.Fatalf("NOTIFY environment variable is invalid: %s", secondary)
+		}
+		n.secondaries = append(n.secondaries, secondary)
+	}
+	return n
+}
+
+// Notify every secondary of the current SOA in the background, retrying with backoff until each acknowledges
+func (n *notifier) notifyAll(soa *dns.SOA) {
+	for _, secondary := range n.secondaries {
+		go n.notify(secondary, soa)
+	}
+}
+
+func (n *notifier) notify(secondary string, soa *dns.SOA) bool {
+	client := &dns.Client{Net: "udp", Timeout: n.timeout}
+	delay := n.initialDelay
+	for attempt := 1; attempt <= n.attempts; attempt++ {
+		msg := new(dns.Msg).SetNotify(soa.Hdr.Name)
+		msg.Answer = []dns.RR{soa}
+		reply, _, err := client.Exchange(msg, secondary)
+		if err == nil && reply.Opcode == dns.OpcodeNotify && reply.Rcode == dns.RcodeSuccess {
+			log.Printf("Notified %s of serial %d\n", secondary, soa.Serial)
+			return true
+		}
+		if err == nil {
+			log.Printf("Failed to notify %s of serial %d (attempt %d): %s\n", secondary, soa.Serial, attempt, dns.RcodeToString[reply.Rcode])
+		} else {
+			log.Printf("Failed to notify %s of serial %d (attempt %d): %v\n", secondary, soa.Serial, attempt, err)
+		}
+		if attempt < n.attempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return false
+}
+
+// Notify the secondaries of the zone's current SOA, as a restart may have changed the configuration
+func (h *DNSHandler) NotifySecondaries() {
+	if h.notifier != nil {
+		h.notifier.notifyAll(h.soaRR())
+	}
+}
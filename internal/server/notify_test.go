@@ -0,0 +1,95 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake secondary recording the serials it's notified of, ignoring the given number of notifies first
+type testSecondary struct {
+	mu       sync.Mutex
+	ignored  int
+	received []uint32
+	notified chan struct{}
+}
+
+func startTestSecondary(t *testing.T, ignored int) (*testSecondary, string) {
+	secondary := &testSecondary{ignored: ignored, notified: make(chan struct{}, 10)}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		secondary.mu.Lock()
+		defer secondary.mu.Unlock()
+		if secondary.ignored > 0 {
+			secondary.ignored--
+			return
+		}
+		if r.Opcode == dns.OpcodeNotify && len(r.Answer) == 1 {
+			secondary.received = append(secondary.received, r.Answer[0].(*dns.SOA).Serial)
+		}
+		w.WriteMsg(new(dns.Msg).SetReply(r))
+		secondary.notified <- struct{}{}
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return secondary, conn.LocalAddr().String()
+}
+
+func (s *testSecondary) serials() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32(nil), s.received...)
+}
+
+func TestNotifiesSecondariesOfSerial(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	secondary, addr := startTestSecondary(t, 0)
+	handler := &DNSHandler{
+		zone:     "example.com.",
+		nsA:      []net.IP{testNsA1},
+		serial:   2024010100,
+		notifier: &notifier{secondaries: []string{addr}, attempts: 3, initialDelay: time.Millisecond, timeout: time.Second},
+	}
+
+	handler.NotifySecondaries()
+
+	select {
+	case <-secondary.notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("secondary was not notified")
+	}
+	assert.Equal(t, []uint32{2024010100}, secondary.serials())
+}
+
+func TestRetriesUnansweredNotifies(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	secondary, addr := startTestSecondary(t, 2)
+	n := &notifier{secondaries: []string{addr}, attempts: 3, initialDelay: time.Millisecond, timeout: 100 * time.Millisecond}
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+		Ns:     "alpha.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Serial: 2024010100,
+	}
+
+	assert.True(t, n.notify(addr, soa))
+	assert.Equal(t, []uint32{2024010100}, secondary.serials())
+
+	secondary.mu.Lock()
+	secondary.ignored = 3
+	secondary.mu.Unlock()
+
+	assert.False(t, n.notify(addr, soa))
+}
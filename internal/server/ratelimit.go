@@ -0,0 +1,243 @@
+package server
+
+import (
+	"crypto/rand"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Response categories, each rate limited with its own bucket per client prefix
+const (
+	rrlCategoryResponse uint8 = iota
+	rrlCategoryNXDomain
+	rrlCategoryError
+)
+
+// What to do with a response after consulting the rate limiter
+const (
+	rrlActionAllow = iota
+	rrlActionDrop
+	rrlActionSlip
+)
+
+// How long a bucket can stay idle before being forgotten
+const rrlBucketIdleTimeout = 10 * time.Second
+
+var rrlCategoryNames = [...]string{"responses", "NXDOMAIN responses", "error responses"}
+
+// Fixed-size key, so that bucket lookups don't need to allocate. Positive responses are told apart by their name and
+// type, as in BIND and Knot, so that a resolver asking for many names isn't limited as if it asked for one
+type rrlKey struct {
+	prefix   [16]byte
+	category uint8
+	qtype    uint16
+	nameHash uint64
+}
+
+type rrlBucket struct {
+	tokens   float64
+	lastSeen time.Time
+	// Responses limited since the bucket last had tokens, used for slipping and logging
+	limited int
+}
+
+// Response Rate Limiting (RRL) as known from BIND and Knot: a token bucket per client prefix and response category
+type rateLimiter struct {
+	// Per-second rates, indexed by category
+	rates            [3]float64
+	slip             int
+	logOnly          bool
+	ipv4PrefixLength int
+	ipv6PrefixLength int
+	now              func() time.Time
+	// Key of the name hashes, random so that clients can't pick names that share buckets
+	hashKey [16]byte
+
+	mu        sync.Mutex
+	buckets   map[rrlKey]*rrlBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(responsesPerSecond, nxdomainsPerSecond, errorsPerSecond float64) *rateLimiter {
+	limiter := &rateLimiter{
+		rates:            [3]float64{responsesPerSecond, nxdomainsPerSecond, errorsPerSecond},
+		slip:             2,
+		ipv4PrefixLength: 24,
+		ipv6PrefixLength: 56,
+		now:              time.Now,
+		buckets:          make(map[rrlKey]*rrlBucket),
+	}
+	if _, err := rand.Read(limiter.hashKey[:]); err != nil {
+		log.Fatalf("Failed to generate the rate limiting hash key: %v", err)
+	}
+	return limiter
+}
+
+// Build a rate limiter from RRL_* environment variables, or return nil if RRL is not enabled
+func newRateLimiterFromEnv() *rateLimiter {
+	responsesPerSecond := parseRateFromEnv("RRL_RESPONSES_PER_SECOND", 0)
+	if responsesPerSecond == 0 {
+		return nil
+	}
+	limiter := newRateLimiter(
+		responsesPerSecond,
+		parseRateFromEnv("RRL_NXDOMAINS_PER_SECOND", responsesPerSecond),
+		parseRateFromEnv("RRL_ERRORS_PER_SECOND", responsesPerSecond),
+	)
+	if slipRaw := os.Getenv("RRL_SLIP"); slipRaw != "" {
+		slip, err := strconv.Atoi(slipRaw)
+		if err != nil || slip < 0 {
+			log.Fatalf("RRL_SLIP environment variable is invalid: %s", slipRaw)
+		}
+		limiter.slip = slip
+	}
+	if logOnlyRaw := os.Getenv("RRL_LOG_ONLY"); logOnlyRaw != "" {
+		logOnly, err := strconv.ParseBool(logOnlyRaw)
+		if err != nil {
+			log.Fatalf("RRL_LOG_ONLY environment variable is invalid: %s", logOnlyRaw)
+		}
+		limiter.logOnly = logOnly
+	}
+	if prefixLengthRaw := os.Getenv("RRL_IPV4_PREFIX_LENGTH"); prefixLengthRaw != "" {
+		prefixLength, err := strconv.Atoi(prefixLengthRaw)
+		if err != nil || prefixLength < 0 || prefixLength > 32 {
+			log.Fatalf("RRL_IPV4_PREFIX_LENGTH environment variable is invalid: %s", prefixLengthRaw)
+		}
+		limiter.ipv4PrefixLength = prefixLength
+	}
+	if prefixLengthRaw := os.Getenv("RRL_IPV6_PREFIX_LENGTH"); prefixLengthRaw != "" {
+		prefixLength, err := strconv.Atoi(prefixLengthRaw)
+		if err != nil || prefixLength < 0 || prefixLength > 128 {
+			log.Fatalf("RRL_IPV6_PREFIX_LENGTH environment variable is invalid: %s", prefixLengthRaw)
+		}
+		limiter.ipv6PrefixLength = prefixLength
+	}
+	return limiter
+}
+
+func parseRateFromEnv(name string, fallback float64) float64 {
+	rateRaw := os.Getenv(name)
+	if rateRaw == "" {
+		return fallback
+	}
+	rate, err := strconv.ParseFloat(rateRaw, 64)
+	if err != nil || rate < 0 {
+		log.Fatalf("%s environment variable is invalid: %s", name, rateRaw)
+	}
+	return rate
+}
+
+// Map a response code onto the rate limiting category it's accounted under
+func rrlCategoryForRcode(rcode int) uint8 {
+	switch rcode {
+	case dns.RcodeSuccess:
+		return rrlCategoryResponse
+	case dns.RcodeNameError:
+		return rrlCategoryNXDomain
+	default:
+		return rrlCategoryError
+	}
+}
+
+// Account for a response to the given client and decide whether it should be sent, dropped or slipped. Positive
+// responses are accounted per query type and lowercased name, NXDOMAIN responses per zone, which can only be the one
+// served, and errors per client prefix alone
+func (l *rateLimiter) check(client netip.Addr, category uint8, qtype uint16, name []byte) int {
+	rate := l.rates[category]
+	if rate == 0 {
+		return rrlActionAllow
+	}
+	key := rrlKey{prefix: l.maskClient(client), category: category}
+	if category == rrlCategoryResponse {
+		key.qtype = qtype
+		key.nameHash = sipHash24(l.hashKey, name)
+	}
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > rrlBucketIdleTimeout {
+		l.prune(now)
+	}
+
+	// The bucket holds one second worth of responses, or a single one at rates below one per second
+	capacity := max(rate, 1)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &rrlBucket{tokens: capacity, lastSeen: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = min(bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rate, capacity)
+		bucket.lastSeen = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		if bucket.limited > 0 {
+			log.Printf("Stopped rate limiting %s to %s after limiting %d of them\n", rrlCategoryNames[category], client, bucket.limited)
+			bucket.limited = 0
+		}
+		return rrlActionAllow
+	}
+
+	bucket.limited++
+	if bucket.limited == 1 {
+		if l.logOnly {
+			log.Printf("Would start rate limiting %s to %s (log-only mode)\n", rrlCategoryNames[category], client)
+		} else {
+			log.Printf("Started rate limiting %s to %s\n", rrlCategoryNames[category], client)
+		}
+	}
+	if l.logOnly {
+		return rrlActionAllow
+	}
+	if l.slip > 0 && bucket.limited%l.slip == 0 {
+		return rrlActionSlip
+	}
+	return rrlActionDrop
+}
+
+// Reduce the client address to the prefix under which it's accounted
+func (l *rateLimiter) maskClient(client netip.Addr) [16]byte {
+	var prefix [16]byte
+	if client = client.Unmap(); client.Is4() {
+		ipv4 := client.As4()
+		prefix[10], prefix[11] = 0xff, 0xff
+		maskBytes(prefix[12:], ipv4[:], l.ipv4PrefixLength)
+	} else {
+		ipv6 := client.As16()
+		maskBytes(prefix[:], ipv6[:], l.ipv6PrefixLength)
+	}
+	return prefix
+}
+
+// Copy the first prefixLength bits of src into dst, leaving the rest zeroed
+func maskBytes(dst, src []byte, prefixLength int) {
+	for i := range src {
+		switch {
+		case prefixLength >= 8:
+			dst[i] = src[i]
+			prefixLength -= 8
+		case prefixLength > 0:
+			dst[i] = src[i] &^ (0xff >> prefixLength)
+			prefixLength = 0
+		}
+	}
+}
+
+// Forget buckets that have been idle long enough to be full again
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.lastSeen) > rrlBucketIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRRLName = []byte("10-0-0-1.example.com.")
+
+func newTestRateLimiter(now *time.Time) *rateLimiter {
+	limiter := newRateLimiter(3, 1, 1)
+	limiter.now = func() time.Time { return *now }
+	return limiter
+}
+
+func TestRateLimiterRefillsOverTime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(&now)
+	limiter.slip = 0
+	client := netip.MustParseAddr("192.0.2.1")
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+	}
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+
+	now = now.Add(time.Second / 2)
+	assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+}
+
+func TestRateLimiterAllowsRatesBelowOnePerSecond(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newRateLimiter(0.5, 0.5, 0.5)
+	limiter.now = func() time.Time { return now }
+	limiter.slip = 0
+	client := netip.MustParseAddr("192.0.2.1")
+
+	assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+}
+
+func TestRateLimiterSharesBucketsWithinPrefix(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(&now)
+	limiter.slip = 0
+
+	assert.Equal(t, rrlActionAllow, limiter.check(netip.MustParseAddr("192.0.2.1"), rrlCategoryNXDomain, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(netip.MustParseAddr("192.0.2.200"), rrlCategoryNXDomain, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionAllow, limiter.check(netip.MustParseAddr("192.0.3.1"), rrlCategoryNXDomain, dns.TypeA, testRRLName))
+
+	assert.Equal(t, rrlActionAllow, limiter.check(netip.MustParseAddr("2001:db8:0:1::1"), rrlCategoryNXDomain, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(netip.MustParseAddr("2001:db8:0:2::1"), rrlCategoryNXDomain, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionAllow, limiter.check(netip.MustParseAddr("2001:db8:0:100::1"), rrlCategoryNXDomain, dns.TypeA, testRRLName))
+}
+
+func TestRateLimiterSeparatesResponsesByNameAndType(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(&now)
+	limiter.slip = 0
+	client := netip.MustParseAddr("192.0.2.1")
+	resolver := netip.MustParseAddr("192.0.2.53")
+
+	// A resolver in the same prefix asking for many names, and types of a name, gets all of them answered
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryResponse, dns.TypeA, testRRLName))
+	}
+	for _, name := range []string{"10-0-0-2.example.com.", "10-0-0-3.example.com.", "www.example.com."} {
+		assert.Equal(t, rrlActionAllow, limiter.check(resolver, rrlCategoryResponse, dns.TypeA, []byte(name)), name)
+	}
+	assert.Equal(t, rrlActionAllow, limiter.check(resolver, rrlCategoryResponse, dns.TypeAAAA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(resolver, rrlCategoryResponse, dns.TypeA, testRRLName))
+
+	// While NXDOMAIN responses are limited across names
+	assert.Equal(t, rrlActionAllow, limiter.check(resolver, rrlCategoryNXDomain, dns.TypeA, []byte("foo.example.com.")))
+	assert.Equal(t, rrlActionDrop, limiter.check(resolver, rrlCategoryNXDomain, dns.TypeA, []byte("bar.example.com.")))
+}
+
+func TestRateLimiterSeparatesCategories(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(&now)
+	limiter.slip = 0
+	client := netip.MustParseAddr("192.0.2.1")
+
+	assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryForRcode(dns.RcodeNameError), dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryForRcode(dns.RcodeNameError), dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryForRcode(dns.RcodeRefused), dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryForRcode(dns.RcodeSuccess), dns.TypeA, testRRLName))
+}
+
+func TestRateLimiterSlips(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(&now)
+	limiter.slip = 3
+	client := netip.MustParseAddr("192.0.2.1")
+
+	assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryError, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryError, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryError, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionSlip, limiter.check(client, rrlCategoryError, dns.TypeA, testRRLName))
+	assert.Equal(t, rrlActionDrop, limiter.check(client, rrlCategoryError, dns.TypeA, testRRLName))
+}
+
+func TestRateLimiterLogOnlyNeverLimits(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newTestRateLimiter(&now)
+	limiter.logOnly = true
+	client := netip.MustParseAddr("192.0.2.1")
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, rrlActionAllow, limiter.check(client, rrlCategoryError, dns.TypeA, testRRLName))
+	}
+}
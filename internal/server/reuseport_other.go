@@ -0,0 +1,13 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package server
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
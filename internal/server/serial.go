@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Serial last issued for the zone, and the hash of the zone it was issued for, as kept in the serial file
+type serialState struct {
+	Serial   uint32 `json:"serial"`
+	ZoneHash uint32 `json:"zone_hash"`
+}
+
+// Determine the zone's SOA serial from the SOA_SERIAL environment variable, along with the file that it's to be
+// issued from instead, from SOA_SERIAL_FILE or else beside the record store. Until the file is opened for serving, the
+// serial is the current time, which is also what it stays without a file
+func (h *DNSHandler) serialFromEnv() (uint32, string) {
+	if serialRaw := os.Getenv("SOA_SERIAL"); serialRaw != "" {
+		serial, err := strconv.ParseUint(serialRaw, 10, 32)
+		if err != nil {
+			log.Fatalf("SOA_SERIAL environment variable is invalid: %s", serialRaw)
+		}
+		return uint32(serial), ""
+	}
+	serialPath := os.Getenv("SOA_SERIAL_FILE")
+	if serialPath == "" && h.recordStorePath != "" {
+		serialPath = h.recordStorePath + ".serial"
+	}
+	return uint32(time.Now().Unix()), serialPath
+}
+
+// Hash the static part of the zone, leaving out the serial itself
+func (h *DNSHandler) zoneHash() uint32 {
+	records := h.zoneRecords()
+	soa := *records[0].(*dns.SOA)
+	soa.Serial = 0
+	records[0] = &soa
+	hash := fnv.New32a()
+	// Without the closing copy of the SOA record
+	for _, record := range records[:len(records)-1] {
+		io.WriteString(hash, record.String())
+		hash.Write([]byte{'\n'})
+	}
+	return hash.Sum32()
+}
+
+// Issue the serial for a zone with the given hash from the serial file: the one last issued if the zone is unchanged,
+// or else a date-based one (YYYYMMDDnn), bumped past the one last issued if that's not greater
+func issueSerial(path string, zoneHash uint32, now time.Time) (uint32, error) {
+	state, found, err := readSerialFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if found && state.ZoneHash == zoneHash {
+		return state.Serial, nil
+	}
+	year, month, day := now.UTC().Date()
+	serial := uint32(year*1000000 + int(month)*10000 + day*100)
+	// Compared with serial number arithmetic (RFC 1982), as secondaries do
+	if found && int32(serial-state.Serial) <= 0 {
+		serial = state.Serial + 1
+	}
+	encoded, err := json.Marshal(serialState{Serial: serial, ZoneHash: zoneHash})
+	if err != nil {
+		return 0, err
+	}
+	// Replaced in one go, so that a crash can't lose the serial last issued
+	if err := replaceFileSynced(path, append(encoded, '\n')); err != nil {
+		return 0, err
+	}
+	return serial, nil
+}
+
+// Read the serial file, which doesn't exist until the first serial is issued
+func readSerialFile(path string) (serialState, bool, error) {
+	var state serialState
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, false, nil
+	} else if err != nil {
+		return state, false, err
+	}
+	if err := json.Unmarshal(encoded, &state); err != nil {
+		return state, false, fmt.Errorf("corrupted: %w", err)
+	}
+	return state, true, nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssuesIncreasingSerials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial")
+	day := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	serial, err := issueSerial(path, 1, day)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2024010100), serial)
+
+	// Unchanged zones keep their serial, even on another day
+	serial, err = issueSerial(path, 1, day.Add(24*time.Hour))
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2024010100), serial)
+
+	for _, expected := range []uint32{2024010101, 2024010102} {
+		serial, err = issueSerial(path, expected, day)
+
+		assert.NoError(t, err)
+		assert.Equal(t, expected, serial)
+	}
+
+	// Going back to an earlier zone is a change too
+	serial, err = issueSerial(path, 1, day)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2024010103), serial)
+
+	serial, err = issueSerial(path, 2, day.Add(24*time.Hour))
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2024010200), serial)
+
+	// Never lower than the last one, even if the clock is behind
+	serial, err = issueSerial(path, 3, day)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2024010201), serial)
+}
+
+func TestBumpsSerialWhenZoneChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial")
+	newHandler := func(rootTXT string) *DNSHandler {
+		handler := &DNSHandler{zone: "example.com.", nsA: []net.IP{testNsA1}, rootTXT: []string{rootTXT}, serialPath: path}
+		if err := handler.OpenStores(); err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+
+	first := newHandler("v=spf1 -all").soaRR().Serial
+
+	assert.Equal(t, first, newHandler("v=spf1 -all").soaRR().Serial)
+
+	changed := newHandler("v=spf1 mx -all").soaRR().Serial
+
+	assert.Greater(t, int32(changed-first), int32(0))
+
+	changedBack := newHandler("v=spf1 -all").soaRR().Serial
+
+	assert.Greater(t, int32(changedBack-changed), int32(0))
+}
+
+func TestChecksSerialFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial")
+	handler := &DNSHandler{zone: "example.com.", nsA: []net.IP{testNsA1}, serialPath: path}
+
+	assert.NoError(t, handler.CheckStores())
+	_, err := os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	os.WriteFile(path, []byte("not json\n"), 0o600)
+
+	assert.ErrorContains(t, handler.CheckStores(), "corrupted")
+}
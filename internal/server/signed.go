@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Twixes/backname/pkg/backname"
+)
+
+// Read the secret that IP-derived names must be signed with from the SIGNED_NAMES_SECRET environment variable, as
+// hex, or nil if names don't need signing
+func nameSecretFromEnv() []byte {
+	secretRaw := os.Getenv("SIGNED_NAMES_SECRET")
+	if secretRaw == "" {
+		return nil
+	}
+	secret, err := hex.DecodeString(secretRaw)
+	if err != nil || len(secret) < backname.MinSecretLength {
+		log.Fatalf("SIGNED_NAMES_SECRET environment variable is invalid: %s", secretRaw)
+	}
+	return secret
+}
+
+// IPv6 address that the subdomain resolves to, which must be signed if a secret is set, or nil if there's none, and
+// the TTL of its record, shortened so that it isn't cached past the name's expiry
+func (h *DNSHandler) parseIPv6Subdomain(subdomain string) (net.IP, uint32) {
+	if h.nameSecret == nil {
+		return backname.ParseIPv6Subdomain(subdomain), h.ttlFor(ttlClassIP)
+	}
+	now := time.Now()
+	if ip, expires := backname.ParseSignedSubdomain(subdomain, h.nameSecret, now); ip != nil && ip.To4() == nil {
+		return ip, h.signedNameTTL(expires, now)
+	}
+	return nil, 0
+}
+
+// IPv4 address that the subdomain resolves to, which must be signed if a secret is set, or nil if there's none, and
+// the TTL of its record, shortened so that it isn't cached past the name's expiry
+func (h *DNSHandler) parseIPv4Subdomain(subdomain string) (net.IP, uint32) {
+	if h.nameSecret == nil {
+		return backname.ParseIPv4Subdomain(subdomain), h.ttlFor(ttlClassIP)
+	}
+	now := time.Now()
+	if ip, expires := backname.ParseSignedSubdomain(subdomain, h.nameSecret, now); ip.To4() != nil {
+		return ip, h.signedNameTTL(expires, now)
+	}
+	return nil, 0
+}
+
+func (h *DNSHandler) signedNameTTL(expires time.Time, now time.Time) uint32 {
+	ttl := h.ttlFor(ttlClassIP)
+	if !expires.IsZero() {
+		ttl = min(ttl, uint32(expires.Sub(now).Seconds()))
+	}
+	return ttl
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Twixes/backname/pkg/backname"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvesOnlySignedNames(t *testing.T) {
+	handler := newTestTransferHandler()
+	handler.nameSecret = []byte("0123456789abcdef")
+	ipv4Name, _ := backname.EncodeSigned(net.ParseIP("10.0.0.1"), "example.com.", handler.nameSecret, time.Time{}, "foo")
+	ipv6Name, _ := backname.EncodeSigned(net.ParseIP("2001:db8::1"), "example.com.", handler.nameSecret, time.Now().Add(time.Hour), "")
+	expiredName, _ := backname.EncodeSigned(net.ParseIP("10.0.0.1"), "example.com.", handler.nameSecret, time.Now().Add(-time.Second), "")
+
+	records, rcode := handler.ResolveRRs(dns.Question{Name: ipv4Name + ".", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []string{ipv4Name + ".\t86400\tIN\tA\t10.0.0.1"}, recordStrings(records))
+
+	records, rcode = handler.ResolveRRs(dns.Question{Name: ipv6Name + ".", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	if assert.Len(t, records, 1) {
+		// Not cached past the name's expiry
+		assert.InDelta(t, 3600, records[0].Header().Ttl, 2)
+	}
+
+	records, rcode = handler.ResolveRRs(dns.Question{Name: ipv6Name + ".", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Empty(t, records)
+
+	for _, name := range []string{"10-0-0-1.example.com.", "10.0.0.1.example.com.", expiredName + "."} {
+		_, rcode = handler.ResolveRRs(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+		assert.Equal(t, dns.RcodeNameError, rcode, name)
+	}
+
+	// Signatures aren't checked on the fast path
+	wire, err := new(dns.Msg).SetQuestion(ipv4Name+".", dns.TypeA).Pack()
+	assert.NoError(t, err)
+
+	_, handled := newTestFastPathReader(handler).answer(wire, testFastPathClient)
+
+	assert.False(t, handled)
+}
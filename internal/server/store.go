@@ -0,0 +1,140 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Records of dynamic names, created through DNS UPDATE or the HTTP API, kept by name and type
+type recordStore interface {
+	// Record sets of the name by type that haven't expired, or nil if the name has none. The records must not be
+	// modified
+	lookup(name string) map[uint16][]dns.RR
+	// Names with record sets owned by the owner that haven't expired
+	owned(owner string) []string
+	// Apply the changes all at once, or none of them if it fails
+	update(changes []recordChange) error
+	close() error
+}
+
+// New record set of a name and type, deleting it if there are no records
+type recordChange struct {
+	name    string
+	rrtype  uint16
+	records []dns.RR
+	// When the record set stops being served and gets deleted, never if zero
+	expires time.Time
+	// Identifier of the API token that created the record set, empty if created through DNS UPDATE
+	owner string
+}
+
+type storedRecordSet struct {
+	records []dns.RR
+	expires time.Time
+	owner   string
+}
+
+func (s storedRecordSet) isExpired(now time.Time) bool {
+	return !s.expires.IsZero() && !now.Before(s.expires)
+}
+
+// Record store living in memory only
+type memoryStore struct {
+	mu    sync.RWMutex
+	names map[string]map[uint16]storedRecordSet
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{names: make(map[string]map[uint16]storedRecordSet)}
+}
+
+func (s *memoryStore) lookup(name string) map[uint16][]dns.RR {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	var sets map[uint16][]dns.RR
+	for rrtype, set := range s.names[name] {
+		if set.isExpired(now) {
+			continue
+		}
+		if sets == nil {
+			sets = make(map[uint16][]dns.RR)
+		}
+		sets[rrtype] = set.records
+	}
+	return sets
+}
+
+func (s *memoryStore) owned(owner string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	var names []string
+	for name, sets := range s.names {
+		for _, set := range sets {
+			if set.owner == owner && !set.isExpired(now) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (s *memoryStore) update(changes []recordChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(changes)
+	s.deleteExpired(time.Now())
+	return nil
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
+
+// Apply changes to the record sets, leaving out names without any. The lock must be held
+func (s *memoryStore) apply(changes []recordChange) {
+	for _, change := range changes {
+		sets := s.names[change.name]
+		if len(change.records) == 0 {
+			delete(sets, change.rrtype)
+			if len(sets) == 0 {
+				delete(s.names, change.name)
+			}
+			continue
+		}
+		if sets == nil {
+			sets = make(map[uint16]storedRecordSet)
+			s.names[change.name] = sets
+		}
+		sets[change.rrtype] = storedRecordSet{records: change.records, expires: change.expires, owner: change.owner}
+	}
+}
+
+// Delete the record sets that have expired. The lock must be held
+func (s *memoryStore) deleteExpired(now time.Time) {
+	for name, sets := range s.names {
+		for rrtype, set := range sets {
+			if set.isExpired(now) {
+				delete(sets, rrtype)
+			}
+		}
+		if len(sets) == 0 {
+			delete(s.names, name)
+		}
+	}
+}
+
+// Number of record sets stored, expired or not. The lock must be held
+func (s *memoryStore) size() int {
+	size := 0
+	for _, sets := range s.names {
+		size += len(sets)
+	}
+	return size
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestLogStore(t *testing.T, path string) *logStore {
+	store, err := openLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.close() })
+	return store
+}
+
+func TestExpiresRecordSets(t *testing.T) {
+	store := newMemoryStore()
+
+	assert.NoError(t, store.update([]recordChange{
+		{name: "pr-1.ci.example.com.", rrtype: dns.TypeA, records: []dns.RR{mustRR(t, "pr-1.ci.example.com. 60 IN A 10.1.2.3")}, expires: time.Now().Add(-time.Second)},
+		{name: "pr-1.ci.example.com.", rrtype: dns.TypeTXT, records: []dns.RR{mustRR(t, "pr-1.ci.example.com. 60 IN TXT \"live\"")}, expires: time.Now().Add(time.Hour)},
+		{name: "pr-2.ci.example.com.", rrtype: dns.TypeA, records: []dns.RR{mustRR(t, "pr-2.ci.example.com. 60 IN A 10.1.2.4")}, expires: time.Now().Add(-time.Second)},
+	}))
+
+	sets := store.lookup("pr-1.ci.example.com.")
+	assert.Len(t, sets, 1)
+	assert.Contains(t, sets, dns.TypeTXT)
+	assert.Nil(t, store.lookup("pr-2.ci.example.com."))
+	assert.Equal(t, 1, store.size())
+}
+
+func TestPersistsRecordSetsInLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.log")
+	store := openTestLogStore(t, path)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	assert.NoError(t, store.update([]recordChange{
+		{name: "pr-1.ci.example.com.", rrtype: dns.TypeA, records: []dns.RR{mustRR(t, "pr-1.ci.example.com. 60 IN A 10.1.2.3")}, expires: expires},
+		{name: "pr-2.ci.example.com.", rrtype: dns.TypeTXT, records: []dns.RR{mustRR(t, "pr-2.ci.example.com. 60 IN TXT \"a b\" \"c\"")}},
+	}))
+	assert.NoError(t, store.update([]recordChange{{name: "pr-2.ci.example.com.", rrtype: dns.TypeTXT}}))
+	assert.NoError(t, store.close())
+
+	reopened := openTestLogStore(t, path)
+
+	assert.Equal(t, []string{"pr-1.ci.example.com.\t60\tIN\tA\t10.1.2.3"}, recordStrings(reopened.lookup("pr-1.ci.example.com.")[dns.TypeA]))
+	assert.Equal(t, expires, reopened.names["pr-1.ci.example.com."][dns.TypeA].expires)
+	assert.Nil(t, reopened.lookup("pr-2.ci.example.com."))
+}
+
+func TestDropsTornBatchFromLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	path := filepath.Join(t.TempDir(), "records.log")
+	store := openTestLogStore(t, path)
+	assert.NoError(t, store.update([]recordChange{
+		{name: "pr-1.ci.example.com.", rrtype: dns.TypeA, records: []dns.RR{mustRR(t, "pr-1.ci.example.com. 60 IN A 10.1.2.3")}},
+	}))
+	assert.NoError(t, store.close())
+	intact, _ := os.ReadFile(path)
+
+	// As if the process crashed in the middle of writing a batch
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	file.WriteString(`{"changes":[{"name":"pr-2.ci.example.com.","ty`)
+	file.Close()
+	reopened := openTestLogStore(t, path)
+
+	assert.NotNil(t, reopened.lookup("pr-1.ci.example.com."))
+	assert.Nil(t, reopened.lookup("pr-2.ci.example.com."))
+	replayed, _ := os.ReadFile(path)
+	assert.Equal(t, intact, replayed)
+
+	// Anything but the end being cut off is corruption, which mustn't go unnoticed
+	assert.NoError(t, reopened.close())
+	os.WriteFile(path, append([]byte("not json\n"), intact...), 0o600)
+
+	_, err := openLogStore(path)
+
+	assert.ErrorContains(t, err, "corrupted")
+}
+
+func TestChecksLogWithoutWritingToIt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.log")
+	store := openTestLogStore(t, path)
+	assert.NoError(t, store.update([]recordChange{
+		{name: "pr-1.ci.example.com.", rrtype: dns.TypeA, records: []dns.RR{mustRR(t, "pr-1.ci.example.com. 60 IN A 10.1.2.3")}},
+	}))
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	file.WriteString(`{"changes":[{"name":"pr-2.ci.example.com.","ty`)
+	file.Close()
+	before, _ := os.Stat(path)
+	contents, _ := os.ReadFile(path)
+
+	assert.NoError(t, checkLogStore(path))
+
+	// The server's file is left alone: neither the torn batch truncated nor the log compacted into a new file
+	after, _ := os.Stat(path)
+	assert.True(t, os.SameFile(before, after))
+	replayed, _ := os.ReadFile(path)
+	assert.Equal(t, contents, replayed)
+
+	os.WriteFile(path, append([]byte("not json\n"), contents...), 0o600)
+
+	assert.ErrorContains(t, checkLogStore(path), "corrupted")
+	assert.NoError(t, checkLogStore(filepath.Join(t.TempDir(), "missing.log")))
+}
+
+func TestCompactsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.log")
+	store := openTestLogStore(t, path)
+
+	for i := range logStoreCompactionSlack + 10 {
+		record := mustRR(t, fmt.Sprintf("pr-1.ci.example.com. 60 IN A 10.1.%d.%d", i/256, i%256))
+		assert.NoError(t, store.update([]recordChange{{name: "pr-1.ci.example.com.", rrtype: dns.TypeA, records: []dns.RR{record}}}))
+	}
+
+	compacted, _ := os.ReadFile(path)
+	assert.Less(t, bytes.Count(compacted, []byte("\n")), logStoreCompactionSlack)
+	assert.Equal(t, []string{"pr-1.ci.example.com.\t60\tIN\tA\t10.1.4.9"}, recordStrings(openTestLogStore(t, path).lookup("pr-1.ci.example.com.")[dns.TypeA]))
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Load the ACL of clients allowed to transfer the zone from the TRANSFER_ALLOW environment variable
+func transferACLFromEnv() []netip.Prefix {
+	var acl []netip.Prefix
+	if transferAllowRaw := os.Getenv("TRANSFER_ALLOW"); transferAllowRaw != "" {
+		for _, prefixRaw := range strings.Split(transferAllowRaw, ",") {
+			prefix, err := parsePrefix(prefixRaw)
+			if err != nil {
+				log.Fatalf("TRANSFER_ALLOW environment variable is invalid: %s", prefixRaw)
+			}
+			acl = append(acl, prefix)
+		}
+	}
+	return acl
+}
+
+// Parse a CIDR prefix, or a single address as a prefix covering just it
+func parsePrefix(prefixRaw string) (netip.Prefix, error) {
+	if !strings.Contains(prefixRaw, "/") {
+		addr, err := netip.ParseAddr(prefixRaw)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(prefixRaw)
+	return prefix.Masked(), err
+}
+
+// Check whether the client may transfer the zone, by address or by TSIG
+func (h *DNSHandler) isTransferAllowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	if isTsigValid(w, r) {
+		return true
+	}
+	if client, ok := netip.AddrFromSlice(remoteIP(w)); ok {
+		client = client.Unmap()
+		for _, prefix := range h.transferACL {
+			if prefix.Contains(client) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The static part of the zone in transfer order, starting and ending with the SOA record. IP-derived names are
+// synthesized, so they're left out
+func (h *DNSHandler) zoneRecords() []dns.RR {
+	soa := h.soaRR()
+	records := []dns.RR{soa}
+	for _, name := range staticResponseNames {
+		for _, qtype := range []uint16{dns.TypeNS, dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypeCAA} {
+			// NS records are returned for every name, but only exist at the apex, and nothing can sit next to a CNAME
+			if qtype == dns.TypeNS && name != "" || name == "www." && qtype != dns.TypeCNAME {
+				continue
+			}
+			answers, _ := h.resolveRRs(dns.Question{Name: name + h.zone, Qtype: qtype, Qclass: dns.ClassINET})
+			for _, answer := range answers {
+				// Records of other types, like the addresses following the www CNAME, belong to other names
+				if answer.Header().Rrtype == qtype && answer.Header().Name == name+h.zone {
+					records = append(records, answer)
+				}
+			}
+		}
+	}
+	return append(records, soa)
+}
+
+// Answer an AXFR or IXFR query for the zone. Being this small, the zone always fits in a single message, and IXFR
+// is answered with the whole zone (as allowed by RFC 1995) unless the client is up to date
+func (h *DNSHandler) resolveTransfer(w dns.ResponseWriter, r *dns.Msg, question dns.Question) ([]dns.RR, int) {
+	if !strings.EqualFold(question.Name, h.zone) {
+		return nil, dns.RcodeNotAuth
+	}
+	if !h.isTransferAllowed(w, r) {
+		log.Printf("Refused %s of %s to %s\n", dns.TypeToString[question.Qtype], h.zone, w.RemoteAddr())
+		return nil, dns.RcodeRefused
+	}
+	_, overTCP := w.RemoteAddr().(*net.TCPAddr)
+	if question.Qtype == dns.TypeAXFR && !overTCP {
+		return nil, dns.RcodeRefused
+	}
+
+	if question.Qtype == dns.TypeIXFR {
+		upToDate := false
+		for _, record := range r.Ns {
+			if soa, ok := record.(*dns.SOA); ok {
+				// Serial number arithmetic (RFC 1982)
+				upToDate = int32(h.serial-soa.Serial) <= 0
+			}
+		}
+		// Over UDP, a single SOA record tells the client to retry over TCP (RFC 1995 section 2)
+		if upToDate || !overTCP {
+			return []dns.RR{h.zoneRecords()[0]}, dns.RcodeSuccess
+		}
+	}
+	log.Printf("Transferring %s to %s\n", h.zone, w.RemoteAddr())
+	return h.zoneRecords(), dns.RcodeSuccess
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTsigKeyName = "transfer."
+const testTsigSecret = "c2VjcmV0IGtleSBmb3IgdHJhbnNmZXJzIG9mIHRoZSB6b25lIQ=="
+
+func newTestTransferHandler() *DNSHandler {
+	handler := &DNSHandler{
+		zone:        "example.com.",
+		websiteA:    []net.IP{websiteA},
+		websiteAAAA: []net.IP{websiteAAAA},
+		nsA:         []net.IP{testNsA1, testNsA12},
+		rootTXT:     []string{"v=spf1 -all"},
+		transferACL: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		tsigKeys:    tsigKeyring{testTsigKeyName: {algorithm: dns.HmacSHA256, secret: []byte("secret key for transfers of the zone!")}},
+	}
+	handler.serial = 2024010100
+	return handler
+}
+
+func transferTestZone(t *testing.T, addr string, tsig bool) ([]dns.RR, error) {
+	transfer := &dns.Transfer{}
+	query := new(dns.Msg).SetAxfr("example.com.")
+	if tsig {
+		transfer.TsigSecret = map[string]string{testTsigKeyName: testTsigSecret}
+		query.SetTsig(testTsigKeyName, dns.HmacSHA256, tsigFudge, 0)
+	}
+	envelopes, err := transfer.In(query, addr)
+	if err != nil {
+		return nil, err
+	}
+	var records []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		records = append(records, envelope.RR...)
+	}
+	return records, nil
+}
+
+func TestTransfersStaticZone(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTransferHandler()
+	addr := startTestServers(t, handler, Listener{Net: "tcp", Addr: "127.0.0.1:0", Sockets: 1})
+
+	records, err := transferTestZone(t, addr, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"SOA example.com.",
+		"NS example.com.",
+		"NS example.com.",
+		"A example.com.",
+		"AAAA example.com.",
+		"TXT example.com.",
+		"CNAME www.example.com.",
+		"A alpha.example.com.",
+		"A omega.example.com.",
+		"SOA example.com.",
+	}, recordTypesAndNames(records))
+	assert.Equal(t, uint32(2024010100), records[0].(*dns.SOA).Serial)
+}
+
+func TestRefusesTransfersOutsideACL(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTransferHandler()
+	handler.transferACL = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	addr := startTestServers(t, handler, Listener{Net: "tcp", Addr: "127.0.0.1:0", Sockets: 1})
+
+	_, err := transferTestZone(t, addr, false)
+
+	assert.ErrorContains(t, err, "bad xfr rcode")
+
+	// A TSIG signature allows the transfer regardless of the address, and the response is signed too
+	records, err := transferTestZone(t, addr, true)
+
+	assert.NoError(t, err)
+	assert.Len(t, records, 10)
+}
+
+func TestRefusesAXFROverUDP(t *testing.T) {
+	handler := newTestTransferHandler()
+	writer := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+
+	handler.ServeDNS(writer, new(dns.Msg).SetAxfr("example.com."))
+
+	assert.Equal(t, dns.RcodeRefused, writer.messages[0].Rcode)
+}
+
+func TestAnswersIXFRWithSOAIfUpToDate(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTransferHandler()
+	writer := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+
+	handler.ServeDNS(writer, new(dns.Msg).SetIxfr("example.com.", 2024010100, "alpha.example.com.", "hostmaster.example.com."))
+	handler.ServeDNS(writer, new(dns.Msg).SetIxfr("example.com.", 2023010100, "alpha.example.com.", "hostmaster.example.com."))
+
+	assert.Equal(t, []string{"SOA example.com."}, recordTypesAndNames(writer.messages[0].Answer))
+	assert.Len(t, writer.messages[1].Answer, 10)
+
+	// Over UDP, the SOA makes an outdated client retry over TCP
+	writer.remoteAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	handler.ServeDNS(writer, new(dns.Msg).SetIxfr("example.com.", 2023010100, "alpha.example.com.", "hostmaster.example.com."))
+
+	assert.Equal(t, []string{"SOA example.com."}, recordTypesAndNames(writer.messages[2].Answer))
+}
+
+func TestRefusesTransfersOfOtherZones(t *testing.T) {
+	handler := newTestTransferHandler()
+	writer := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+
+	handler.ServeDNS(writer, new(dns.Msg).SetAxfr("www.example.com."))
+
+	assert.Equal(t, dns.RcodeNotAuth, writer.messages[0].Rcode)
+}
+
+func TestParsesPrefixes(t *testing.T) {
+	prefix, err := parsePrefix("192.0.2.7")
+
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("192.0.2.7/32"), prefix)
+
+	prefix, err = parsePrefix("2001:db8::1/32")
+
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("2001:db8::/32"), prefix)
+
+	_, err = parsePrefix("192.0.2.0/33")
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How far the time signed in a TSIG can be off, as recommended by RFC 8945
+const tsigFudge = 300
+
+// Supported TSIG algorithms, by name
+var tsigAlgorithms = map[string]func() hash.Hash{
+	dns.HmacSHA256: sha256.New,
+	dns.HmacSHA512: sha512.New,
+}
+
+type tsigKey struct {
+	algorithm string
+	secret    []byte
+}
+
+// TSIG keys by canonical name, all of them active at once so that keys can be rotated without downtime. Used as
+// the servers' TsigProvider, so that each key only verifies with its own algorithm
+type tsigKeyring map[string]tsigKey
+
+// Load TSIG keys from the TSIG_KEYS environment variable, as comma-separated <name>:[<algorithm>:]<base64 secret>,
+// the algorithm being hmac-sha256 (the default) or hmac-sha512
+func tsigKeyringFromEnv() tsigKeyring {
+	tsigKeysRaw := os.Getenv("TSIG_KEYS")
+	if tsigKeysRaw == "" {
+		return nil
+	}
+	keyring := make(tsigKeyring)
+	for _, tsigKeyRaw := range strings.Split(tsigKeysRaw, ",") {
+		name, key, err := parseTsigKey(tsigKeyRaw)
+		if err != nil {
+			// The secret is left out of the message on purpose
+			log.Fatalf("TSIG_KEYS environment variable is invalid: %s (%v)", name, err)
+		}
+		keyring[name] = key
+	}
+	return keyring
+}
+
+func parseTsigKey(tsigKeyRaw string) (string, tsigKey, error) {
+	parts := strings.Split(tsigKeyRaw, ":")
+	name := dns.CanonicalName(parts[0])
+	algorithm := dns.HmacSHA256
+	switch len(parts) {
+	case 2:
+	case 3:
+		algorithm = dns.CanonicalName(parts[1])
+		if _, ok := tsigAlgorithms[algorithm]; !ok {
+			return name, tsigKey{}, errors.New("algorithm must be hmac-sha256 or hmac-sha512")
+		}
+	default:
+		return name, tsigKey{}, errors.New("key must be <name>:[<algorithm>:]<secret>")
+	}
+	secret, err := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+	if parts[0] == "" || err != nil || len(secret) == 0 {
+		return name, tsigKey{}, errors.New("key must have a name and a base64 secret")
+	}
+	return name, tsigKey{algorithm: algorithm, secret: secret}, nil
+}
+
+func (k tsigKeyring) mac(message []byte, t *dns.TSIG) ([]byte, error) {
+	key, ok := k[dns.CanonicalName(t.Hdr.Name)]
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+	if !strings.EqualFold(t.Algorithm, key.algorithm) {
+		return nil, dns.ErrKeyAlg
+	}
+	h := hmac.New(tsigAlgorithms[key.algorithm], key.secret)
+	h.Write(message)
+	return h.Sum(nil), nil
+}
+
+func (k tsigKeyring) Generate(message []byte, t *dns.TSIG) ([]byte, error) {
+	return k.mac(message, t)
+}
+
+func (k tsigKeyring) Verify(message []byte, t *dns.TSIG) error {
+	expected, err := k.mac(message, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil || !hmac.Equal(mac, expected) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// Check whether the request carries a valid TSIG signature
+func isTsigValid(w dns.ResponseWriter, r *dns.Msg) bool {
+	return r.IsTsig() != nil && w.TsigStatus() == nil
+}
+
+// Prepare the response to a validly signed request to be signed with the same key when written
+func signResponse(r *dns.Msg, msg *dns.Msg) {
+	requestTsig := r.IsTsig()
+	msg.SetTsig(requestTsig.Hdr.Name, requestTsig.Algorithm, tsigFudge, time.Now().Unix())
+}
+
+// Size of the TSIG record that will sign the response, or 0 if the request wasn't validly signed
+func tsigLen(w dns.ResponseWriter, r *dns.Msg) int {
+	if !isTsigValid(w, r) {
+		return 0
+	}
+	requestTsig := r.IsTsig()
+	// With the same algorithm, the response's MAC is as long as the request's
+	return dns.Len(&dns.TSIG{
+		Hdr:       dns.RR_Header{Name: requestTsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm: requestTsig.Algorithm,
+		MAC:       requestTsig.MAC,
+	})
+}
+
+// Empty a response that's too large to be signed over UDP, making the client retry over TCP
+func truncateForTsig(msg *dns.Msg) {
+	msg.Answer = nil
+	msg.Ns = nil
+	msg.Extra = slices.DeleteFunc(msg.Extra, func(record dns.RR) bool { return record.Header().Rrtype != dns.TypeOPT })
+	msg.Truncated = true
+}
+
+// Load the query types only answered to signed requests from the TSIG_PRIVILEGED_TYPES environment variable
+func privilegedTypesFromEnv() map[uint16]bool {
+	privilegedTypesRaw := os.Getenv("TSIG_PRIVILEGED_TYPES")
+	if privilegedTypesRaw == "" {
+		return nil
+	}
+	privilegedTypes := make(map[uint16]bool)
+	for _, typeRaw := range strings.Split(privilegedTypesRaw, ",") {
+		qtype, ok := dns.StringToType[strings.ToUpper(typeRaw)]
+		// Transfers are authorized on their own, ANY only returns the types that aren't privileged, and OPT isn't queried
+		if !ok || qtype == dns.TypeAXFR || qtype == dns.TypeIXFR || qtype == dns.TypeANY || qtype == dns.TypeOPT {
+			log.Fatalf("TSIG_PRIVILEGED_TYPES environment variable is invalid: %s", typeRaw)
+		}
+		privilegedTypes[qtype] = true
+	}
+	return privilegedTypes
+}
+
+// Filter out the records of privileged types, for responses to unsigned requests
+func (h *DNSHandler) withoutPrivilegedTypes(records []dns.RR) []dns.RR {
+	if len(h.privilegedTypes) == 0 {
+		return records
+	}
+	return slices.DeleteFunc(records, func(record dns.RR) bool { return h.privilegedTypes[record.Header().Rrtype] })
+}
+
+// Respond to a request whose TSIG failed verification with NOTAUTH and the TSIG error (RFC 8945 section 5.2),
+// unsigned unless the only problem is the time
+func (h *DNSHandler) writeTsigError(w dns.ResponseWriter, r *dns.Msg, tsigStatus error) {
+	requestTsig := r.IsTsig()
+	tsigError := dns.RcodeBadSig
+	switch tsigStatus {
+	case dns.ErrSecret, dns.ErrKeyAlg:
+		tsigError = dns.RcodeBadKey
+	case dns.ErrTime:
+		tsigError = dns.RcodeBadTime
+	}
+	log.Printf("Rejected TSIG of %s from %s: %s\n", requestTsig.Hdr.Name, w.RemoteAddr(), dns.RcodeToString[tsigError])
+
+	msg := new(dns.Msg)
+	msg.SetRcode(r, dns.RcodeNotAuth)
+	responseTsig := &dns.TSIG{
+		Hdr:        dns.RR_Header{Name: requestTsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm:  requestTsig.Algorithm,
+		TimeSigned: requestTsig.TimeSigned,
+		Fudge:      tsigFudge,
+		OrigId:     r.Id,
+		Error:      uint16(tsigError),
+	}
+	requestMAC := ""
+	if tsigError == dns.RcodeBadTime {
+		// The server's time lets the client tell how far off its clock is
+		otherData := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))[2:]
+		responseTsig.OtherData = hex.EncodeToString(otherData)
+		responseTsig.OtherLen = uint16(len(otherData))
+		requestMAC = requestTsig.MAC
+	}
+	msg.Extra = append(msg.Extra, responseTsig)
+
+	// Written as is, since WriteMsg would fail to sign with an unknown key
+	data, _, err := dns.TsigGenerateWithProvider(msg, h.tsigKeys, requestMAC, false)
+	if err != nil {
+		log.Printf("Failed to sign TSIG error response: %v\n", err)
+		return
+	}
+	w.Write(data)
+}
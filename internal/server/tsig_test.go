@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTsigRotatedKeyName = "rotated."
+const testTsigRotatedSecret = "bmV3ZXIgc2VjcmV0IGtleSwgaW4gdXNlIGR1cmluZyByb3RhdGlvbiBvZiB0aGUgb2xkIG9uZSBieSB0aGUgb3BlcmF0b3I="
+
+func newTestTsigHandler() *DNSHandler {
+	handler := newTestTransferHandler()
+	_, rotatedKey, _ := parseTsigKey(testTsigRotatedKeyName + ":hmac-sha512:" + testTsigRotatedSecret)
+	handler.tsigKeys[testTsigRotatedKeyName] = rotatedKey
+	handler.privilegedTypes = map[uint16]bool{dns.TypeTXT: true}
+	return handler
+}
+
+// Exchange a query signed with the given key, returning the reply even if its TSIG doesn't verify
+func exchangeSigned(net, addr, keyName, algorithm, secret string, timeSigned int64, query *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: net, TsigSecret: map[string]string{keyName: secret}}
+	query.SetTsig(keyName, algorithm, tsigFudge, timeSigned)
+	reply, _, err := client.Exchange(query, addr)
+	return reply, err
+}
+
+func TestParsesTsigKeys(t *testing.T) {
+	name, key, err := parseTsigKey("Transfer:" + testTsigSecret)
+
+	assert.NoError(t, err)
+	assert.Equal(t, testTsigKeyName, name)
+	assert.Equal(t, tsigKey{algorithm: dns.HmacSHA256, secret: []byte("secret key for transfers of the zone!")}, key)
+
+	_, key, err = parseTsigKey("rotated:HMAC-SHA512:" + testTsigSecret)
+
+	assert.NoError(t, err)
+	assert.Equal(t, dns.HmacSHA512, key.algorithm)
+
+	for _, tsigKeyRaw := range []string{"transfer", "transfer:hmac-md5:" + testTsigSecret, ":" + testTsigSecret, "transfer:not base64", "transfer:"} {
+		_, _, err = parseTsigKey(tsigKeyRaw)
+
+		assert.Error(t, err, tsigKeyRaw)
+	}
+}
+
+func TestSignsResponsesWithEveryActiveKey(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTsigHandler()
+	addr := startTestServers(t, handler, Listener{Net: "udp", Addr: "127.0.0.1:0", Sockets: 1})
+
+	// The client verifies the signature of the response, failing if it's missing or invalid
+	reply, err := exchangeSigned("udp", addr, testTsigKeyName, dns.HmacSHA256, testTsigSecret, 0, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.NotNil(t, reply.IsTsig())
+
+	reply, err = exchangeSigned("udp", addr, testTsigRotatedKeyName, dns.HmacSHA512, testTsigRotatedSecret, 0, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.NotNil(t, reply.IsTsig())
+}
+
+func TestRejectsInvalidTsigs(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTsigHandler()
+	addr := startTestServers(t, handler, Listener{Net: "udp", Addr: "127.0.0.1:0", Sockets: 1})
+
+	testCases := []struct {
+		name       string
+		keyName    string
+		algorithm  string
+		secret     string
+		timeSigned int64
+		tsigError  int
+	}{
+		{"unknown key", "unknown.", dns.HmacSHA256, testTsigSecret, 0, dns.RcodeBadKey},
+		{"wrong algorithm", testTsigKeyName, dns.HmacSHA512, testTsigSecret, 0, dns.RcodeBadKey},
+		{"wrong secret", testTsigKeyName, dns.HmacSHA256, testTsigRotatedSecret, 0, dns.RcodeBadSig},
+		{"time off", testTsigKeyName, dns.HmacSHA256, testTsigSecret, time.Now().Unix() - 3600, dns.RcodeBadTime},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			reply, _ := exchangeSigned("udp", addr, testCase.keyName, testCase.algorithm, testCase.secret, testCase.timeSigned, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+
+			assert.Equal(t, dns.RcodeNotAuth, reply.Rcode)
+			assert.Empty(t, reply.Answer)
+			assert.Equal(t, uint16(testCase.tsigError), reply.IsTsig().Error)
+			if testCase.tsigError == dns.RcodeBadTime {
+				// Signed, with the server's time
+				assert.NotEmpty(t, reply.IsTsig().MAC)
+				assert.Equal(t, uint16(6), reply.IsTsig().OtherLen)
+			} else {
+				assert.Empty(t, reply.IsTsig().MAC)
+			}
+		})
+	}
+}
+
+func TestRejectsTsigsWithoutKeys(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTransferHandler()
+	handler.tsigKeys = nil
+	handler.transferACL = nil
+	addr := startTestServers(t, handler, Listener{Net: "tcp", Addr: "127.0.0.1:0", Sockets: 1})
+
+	// Without keys, a TSIG can't be verified, so it mustn't be trusted either
+	reply, _ := exchangeSigned("tcp", addr, testTsigKeyName, dns.HmacSHA256, testTsigSecret, 0, new(dns.Msg).SetAxfr("example.com."))
+
+	assert.Equal(t, dns.RcodeNotAuth, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+	assert.Equal(t, uint16(dns.RcodeBadKey), reply.IsTsig().Error)
+}
+
+func TestAnswersPrivilegedTypesOnlyToSignedRequests(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTsigHandler()
+	addr := startTestServers(t, handler, Listener{Net: "udp", Addr: "127.0.0.1:0", UDPSize: dns.MaxMsgSize, Sockets: 1, FastPath: true})
+	handler.rebuildStaticResponses()
+
+	reply, err := dns.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT), addr)
+
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+
+	reply, err = dns.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeANY), addr)
+
+	assert.NoError(t, err)
+	for _, answer := range reply.Answer {
+		assert.NotEqual(t, dns.TypeTXT, answer.Header().Rrtype)
+	}
+
+	reply, err = exchangeSigned("udp", addr, testTsigKeyName, dns.HmacSHA256, testTsigSecret, 0, new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT))
+
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, []string{"TXT example.com."}, recordTypesAndNames(reply.Answer))
+}
+
+func TestTruncatesSignedResponsesTooLargeForUDP(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestTsigHandler()
+	handler.rootTXT = []string{string(make([]byte, 200)), string(make([]byte, 200))}
+	addr := startTestServers(t, handler, Listener{Net: "udp", Addr: "127.0.0.1:0", Sockets: 1})
+
+	reply, err := exchangeSigned("udp", addr, testTsigRotatedKeyName, dns.HmacSHA512, testTsigRotatedSecret, 0, new(dns.Msg).SetQuestion("example.com.", dns.TypeTXT))
+
+	assert.NoError(t, err)
+	assert.True(t, reply.Truncated)
+	assert.Empty(t, reply.Answer)
+	assert.NotNil(t, reply.IsTsig())
+}
+
+func TestTsigKeyringVerifiesOwnMACs(t *testing.T) {
+	keyring := tsigKeyring{testTsigKeyName: {algorithm: dns.HmacSHA256, secret: []byte("secret")}}
+	tsig := &dns.TSIG{Hdr: dns.RR_Header{Name: "Transfer."}, Algorithm: dns.HmacSHA256}
+
+	mac, err := keyring.Generate([]byte("message"), tsig)
+
+	assert.NoError(t, err)
+	assert.Len(t, mac, 32)
+
+	tsig.MAC = hex.EncodeToString(mac)
+	assert.NoError(t, keyring.Verify([]byte("message"), tsig))
+	assert.ErrorIs(t, keyring.Verify([]byte("forged message"), tsig), dns.ErrSig)
+}
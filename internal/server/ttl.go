@@ -0,0 +1,75 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Classes of records that can each have their own TTL
+const (
+	ttlClassWebsite    = iota // A/AAAA of the apex website
+	ttlClassWWW               // CNAME of www
+	ttlClassNameserver        // NS, SOA and addresses of alpha/omega
+	ttlClassTXT               // TXT and CAA
+	ttlClassIP                // Records of IP-derived names
+	ttlClassNegative          // Negative caching, as advertised by the SOA record
+	ttlClassCount
+)
+
+var ttlClassVariables = [ttlClassCount]string{"TTL_WEBSITE", "TTL_WWW", "TTL_NAMESERVER", "TTL_TXT", "TTL_IP", "TTL_NEGATIVE"}
+
+// Load TTLs from the TTL_* environment variables, with defaults for those unset
+func ttlsFromEnv() *[ttlClassCount]uint32 {
+	ttls := defaultTTLs()
+	for class, variable := range ttlClassVariables {
+		if ttlRaw := os.Getenv(variable); ttlRaw != "" {
+			classTTL, err := strconv.ParseUint(ttlRaw, 10, 31)
+			if err != nil {
+				log.Fatalf("%s environment variable is invalid: %s", variable, ttlRaw)
+			}
+			ttls[class] = uint32(classTTL)
+		}
+	}
+	return ttls
+}
+
+func defaultTTLs() *[ttlClassCount]uint32 {
+	ttls := new([ttlClassCount]uint32)
+	for class := range ttls {
+		ttls[class] = ttl
+	}
+	ttls[ttlClassNegative] = negativeTTL
+	return ttls
+}
+
+func (h *DNSHandler) ttlFor(class int) uint32 {
+	if h.ttls == nil {
+		if class == ttlClassNegative {
+			return negativeTTL
+		}
+		return ttl
+	}
+	return h.ttls[class]
+}
+
+// The zone's SOA record, with the negative caching TTL as its minimum
+func (h *DNSHandler) soaRR() *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   h.zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    h.ttlFor(ttlClassNameserver),
+		},
+		Ns:      "alpha." + h.zone,
+		Mbox:    "hostmaster." + h.zone,
+		Serial:  h.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  1209600,
+		Minttl:  h.ttlFor(ttlClassNegative),
+	}
+}
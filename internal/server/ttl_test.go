@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvesWithConfiguredTTLs(t *testing.T) {
+	ttls := defaultTTLs()
+	ttls[ttlClassWebsite] = 300
+	ttls[ttlClassWWW] = 600
+	ttls[ttlClassNameserver] = 172800
+	ttls[ttlClassTXT] = 60
+	ttls[ttlClassIP] = 604800
+	handler := DNSHandler{
+		zone:     "example.com.",
+		nsA:      []net.IP{testNsA1},
+		websiteA: []net.IP{websiteA},
+		rootTXT:  []string{"foo"},
+		ttls:     ttls,
+	}
+
+	for _, testCase := range []struct {
+		name  string
+		qtype uint16
+		ttls  []uint32
+	}{
+		{"example.com.", dns.TypeA, []uint32{300}},
+		{"www.example.com.", dns.TypeA, []uint32{600, 300}},
+		{"example.com.", dns.TypeNS, []uint32{172800}},
+		{"alpha.example.com.", dns.TypeA, []uint32{172800}},
+		{"example.com.", dns.TypeTXT, []uint32{60}},
+		{"10-0-0-1.example.com.", dns.TypeA, []uint32{604800}},
+	} {
+		answers, rcode := handler.ResolveRRs(dns.Question{
+			Name:   testCase.name,
+			Qtype:  testCase.qtype,
+			Qclass: dns.ClassINET,
+		})
+
+		assert.Equal(t, dns.RcodeSuccess, rcode)
+		var answerTTLs []uint32
+		for _, answer := range answers {
+			answerTTLs = append(answerTTLs, answer.Header().Ttl)
+		}
+		assert.Equal(t, testCase.ttls, answerTTLs, "TTLs of %s %s", dns.TypeToString[testCase.qtype], testCase.name)
+	}
+}
+
+func TestResolvesSOA(t *testing.T) {
+	handler := DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+	}
+	handler.serial = 2024010100
+
+	answers, rcode := handler.ResolveRRs(dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeSOA,
+		Qclass: dns.ClassINET,
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []dns.RR{
+		&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   "example.com.",
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ns:      "alpha.example.com.",
+			Mbox:    "hostmaster.example.com.",
+			Serial:  2024010100,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  1209600,
+			Minttl:  negativeTTL,
+		},
+	}, answers)
+}
+
+func TestServeDNSAddsSOAToNegativeAnswers(t *testing.T) {
+	ttls := defaultTTLs()
+	ttls[ttlClassNegative] = 30
+	handler := DNSHandler{
+		zone: "example.com.",
+		nsA:  []net.IP{testNsA1},
+		ttls: ttls,
+	}
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("foo.example.com.", dns.TypeA))
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeAAAA))
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA))
+
+	assert.Equal(t, dns.RcodeNameError, w.messages[0].Rcode)
+	for _, msg := range w.messages[:2] {
+		if assert.Len(t, msg.Ns, 1) {
+			soa := msg.Ns[0].(*dns.SOA)
+			assert.Equal(t, uint32(30), soa.Hdr.Ttl)
+			assert.Equal(t, uint32(30), soa.Minttl)
+		}
+	}
+	assert.Empty(t, w.messages[2].Ns)
+}
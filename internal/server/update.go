@@ -0,0 +1,309 @@
+package server
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Record types that can be added to dynamic names
+var updatableTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT}
+
+// Load the subtree of the zone where dynamic names can be created from the UPDATE_SUBTREE environment variable
+func updateSubtreeFromEnv(zone string) string {
+	updateSubtreeRaw := os.Getenv("UPDATE_SUBTREE")
+	if updateSubtreeRaw == "" {
+		return ""
+	}
+	updateSubtree := dns.CanonicalName(updateSubtreeRaw)
+	if _, ok := dns.IsDomainName(updateSubtree); !ok || !dns.IsSubDomain(zone, updateSubtree) {
+		log.Fatalf("UPDATE_SUBTREE environment variable is invalid: %s", updateSubtreeRaw)
+	}
+	return updateSubtree
+}
+
+// Accept DNS UPDATE requests besides what dns.DefaultMsgAcceptFunc accepts, as their sections can hold any number of
+// records
+func acceptMsg(header dns.Header) dns.MsgAcceptAction {
+	isResponse := header.Bits&(1<<15) != 0
+	if opcode := int(header.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && !isResponse {
+		if header.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(header)
+}
+
+// Check whether a dynamic name can live at the (canonical) name, strictly below the update subtree and clear of
+// the static names
+func (h *DNSHandler) isDynamicName(name string) bool {
+	if h.updateSubtree == "" || !strings.HasSuffix(name, "."+h.updateSubtree) {
+		return false
+	}
+	for _, staticName := range staticResponseNames {
+		if name == staticName+h.zone {
+			return false
+		}
+	}
+	return true
+}
+
+// Record sets stored for the name, if it's a dynamic one
+func (h *DNSHandler) lookupDynamic(name string) map[uint16][]dns.RR {
+	name = dns.CanonicalName(name)
+	if !h.isDynamicName(name) {
+		return nil
+	}
+	return h.records.lookup(name)
+}
+
+// Answer a question for a dynamic name from its record sets, with its CNAME if it has one instead of the type
+func dynamicAnswers(sets map[uint16][]dns.RR, question dns.Question) []dns.RR {
+	records, ok := sets[question.Qtype]
+	if !ok {
+		records = sets[dns.TypeCNAME]
+	}
+	answers := make([]dns.RR, len(records))
+	for i, record := range records {
+		answers[i] = dns.Copy(record)
+		answers[i].Header().Name = question.Name
+	}
+	return answers
+}
+
+// Apply a DNS UPDATE (RFC 2136) to the dynamic names, returning the response code. Only requests signed with a TSIG
+// key are accepted, and only A, AAAA, CNAME and TXT records can be added
+func (h *DNSHandler) resolveUpdate(w dns.ResponseWriter, r *dns.Msg) int {
+	// The record store can exist for the HTTP API alone
+	if h.updateSubtree == "" {
+		return dns.RcodeNotImplemented
+	}
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if !strings.EqualFold(r.Question[0].Name, h.zone) {
+		return dns.RcodeNotAuth
+	}
+	if !isTsigValid(w, r) {
+		log.Printf("Refused unsigned update from %s\n", w.RemoteAddr())
+		return dns.RcodeRefused
+	}
+
+	// Updates are serialized, so that nothing changes between checking the prerequisites and applying the changes
+	h.updateMu.Lock()
+	defer h.updateMu.Unlock()
+
+	if rcode := h.checkUpdatePrerequisites(r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := h.prescanUpdate(r.Ns); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	// Changes are applied to copies of the record sets of the names involved, then stored all at once
+	names := make(map[string]map[uint16][]dns.RR)
+	var changed []recordChange
+	for _, record := range r.Ns {
+		header := record.Header()
+		name := dns.CanonicalName(header.Name)
+		sets, ok := names[name]
+		if !ok {
+			sets = h.records.lookup(name)
+			if sets == nil {
+				sets = make(map[uint16][]dns.RR)
+			}
+			names[name] = sets
+		}
+		for _, rrtype := range applyUpdate(sets, record) {
+			if !slices.ContainsFunc(changed, func(change recordChange) bool { return change.name == name && change.rrtype == rrtype }) {
+				changed = append(changed, recordChange{name: name, rrtype: rrtype})
+			}
+		}
+	}
+	for i := range changed {
+		changed[i].records = names[changed[i].name][changed[i].rrtype]
+		if h.recordLifetime > 0 {
+			changed[i].expires = time.Now().Add(h.recordLifetime)
+		}
+	}
+	if err := h.records.update(changed); err != nil {
+		log.Printf("Failed to store update from %s: %v\n", w.RemoteAddr(), err)
+		return dns.RcodeServerFailure
+	}
+	log.Printf("Updated %d record sets for %s\n", len(changed), w.RemoteAddr())
+	return dns.RcodeSuccess
+}
+
+// Check the prerequisite section of an update (RFC 2136 section 3.2)
+func (h *DNSHandler) checkUpdatePrerequisites(prerequisites []dns.RR) int {
+	// Value-dependent prerequisites, by name and type, compared as whole record sets
+	expected := make(map[string]map[uint16][]dns.RR)
+	for _, prerequisite := range prerequisites {
+		header := prerequisite.Header()
+		name := dns.CanonicalName(header.Name)
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(h.zone, name) {
+			return dns.RcodeNotZone
+		}
+		if !h.isDynamicName(name) {
+			return dns.RcodeRefused
+		}
+		sets := h.records.lookup(name)
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY && len(sets) == 0 {
+				return dns.RcodeNameError
+			}
+			if _, ok := sets[header.Rrtype]; header.Rrtype != dns.TypeANY && !ok {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype == dns.TypeANY && len(sets) > 0 {
+				return dns.RcodeYXDomain
+			}
+			if _, ok := sets[header.Rrtype]; header.Rrtype != dns.TypeANY && ok {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			if expected[name] == nil {
+				expected[name] = make(map[uint16][]dns.RR)
+			}
+			expected[name][header.Rrtype] = append(expected[name][header.Rrtype], prerequisite)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for name, sets := range expected {
+		stored := h.records.lookup(name)
+		for rrtype, records := range sets {
+			if !isSameRecordSet(stored[rrtype], records) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Check the update section before applying anything (RFC 2136 section 3.4.1)
+func (h *DNSHandler) prescanUpdate(updates []dns.RR) int {
+	for _, update := range updates {
+		header := update.Header()
+		name := dns.CanonicalName(header.Name)
+		if !dns.IsSubDomain(h.zone, name) {
+			return dns.RcodeNotZone
+		}
+		if !h.isDynamicName(name) {
+			log.Printf("Refused update of %s outside of %s\n", name, h.updateSubtree)
+			return dns.RcodeRefused
+		}
+		switch header.Class {
+		case dns.ClassINET:
+			if header.Rdlength == 0 {
+				return dns.RcodeFormatError
+			}
+			if !slices.Contains(updatableTypes, header.Rrtype) {
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 || header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype != dns.TypeANY && !slices.Contains(updatableTypes, header.Rrtype) {
+				return dns.RcodeRefused
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			if !slices.Contains(updatableTypes, header.Rrtype) {
+				return dns.RcodeRefused
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Apply a single update to the record sets of its name (RFC 2136 section 3.4.2), returning the types changed
+func applyUpdate(sets map[uint16][]dns.RR, update dns.RR) []uint16 {
+	header := update.Header()
+	switch header.Class {
+	case dns.ClassINET:
+		// A CNAME can't have other data next to it, so additions clashing with the name's data are ignored
+		_, hasCNAME := sets[dns.TypeCNAME]
+		hasOther := len(sets) > 0 && !hasCNAME
+		if header.Rrtype == dns.TypeCNAME && hasOther || header.Rrtype != dns.TypeCNAME && hasCNAME {
+			return nil
+		}
+		record := dns.Copy(update)
+		record.Header().Name = dns.CanonicalName(header.Name)
+		if header.Rrtype == dns.TypeCNAME {
+			// There's only ever one CNAME, which gets replaced
+			sets[dns.TypeCNAME] = []dns.RR{record}
+			return []uint16{dns.TypeCNAME}
+		}
+		for i, existing := range sets[header.Rrtype] {
+			if dns.IsDuplicate(existing, record) {
+				// Only the TTL can differ, which is updated
+				sets[header.Rrtype] = slices.Clone(sets[header.Rrtype])
+				sets[header.Rrtype][i] = record
+				return []uint16{header.Rrtype}
+			}
+		}
+		sets[header.Rrtype] = append(slices.Clip(sets[header.Rrtype]), record)
+		return []uint16{header.Rrtype}
+	case dns.ClassANY:
+		var deleted []uint16
+		for rrtype := range sets {
+			if header.Rrtype == dns.TypeANY || header.Rrtype == rrtype {
+				delete(sets, rrtype)
+				deleted = append(deleted, rrtype)
+			}
+		}
+		return deleted
+	case dns.ClassNONE:
+		// Compared as if in the zone's class, which is how it's stored
+		record := dns.Copy(update)
+		record.Header().Class = dns.ClassINET
+		records := slices.DeleteFunc(slices.Clone(sets[header.Rrtype]), func(existing dns.RR) bool {
+			return dns.IsDuplicate(existing, record)
+		})
+		if len(records) == len(sets[header.Rrtype]) {
+			return nil
+		}
+		if len(records) == 0 {
+			delete(sets, header.Rrtype)
+		} else {
+			sets[header.Rrtype] = records
+		}
+		return []uint16{header.Rrtype}
+	}
+	return nil
+}
+
+// Compare record sets regardless of order and TTLs
+func isSameRecordSet(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, record := range a {
+		if !slices.ContainsFunc(b, func(other dns.RR) bool { return dns.IsDuplicate(record, other) }) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUpdateHandler(updateSubtree string) *DNSHandler {
+	handler := newTestTransferHandler()
+	handler.updateSubtree = updateSubtree
+	handler.records = newMemoryStore()
+	return handler
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	record, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// Send an update for the zone signed with the test key, returning the response code
+func sendUpdate(t *testing.T, addr string, build func(update *dns.Msg)) int {
+	update := new(dns.Msg).SetUpdate("example.com.")
+	build(update)
+	reply, err := exchangeSigned("tcp", addr, testTsigKeyName, dns.HmacSHA256, testTsigSecret, 0, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply.Rcode
+}
+
+func TestAddsAndDeletesDynamicRecords(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestUpdateHandler("ci.example.com.")
+	addr := startTestServers(t, handler, Listener{Net: "tcp", Addr: "127.0.0.1:0", Sockets: 1})
+
+	rcode := sendUpdate(t, addr, func(update *dns.Msg) {
+		update.Insert([]dns.RR{
+			mustRR(t, "PR-1234.ci.example.com. 60 IN A 10.1.2.3"),
+			mustRR(t, "pr-1234.ci.example.com. 60 IN A 10.1.2.4"),
+			mustRR(t, "pr-1234.ci.example.com. 60 IN TXT \"commit abc\""),
+			mustRR(t, "docs.ci.example.com. 60 IN CNAME pr-1234.ci.example.com."),
+		})
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	records, rcode := handler.ResolveRRs(dns.Question{Name: "pr-1234.ci.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []string{"pr-1234.ci.example.com.\t60\tIN\tA\t10.1.2.3", "pr-1234.ci.example.com.\t60\tIN\tA\t10.1.2.4"}, recordStrings(records))
+	records, _ = handler.ResolveRRs(dns.Question{Name: "docs.ci.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, []string{"docs.ci.example.com.\t60\tIN\tCNAME\tpr-1234.ci.example.com."}, recordStrings(records))
+
+	rcode = sendUpdate(t, addr, func(update *dns.Msg) {
+		update.Remove([]dns.RR{mustRR(t, "pr-1234.ci.example.com. 0 IN A 10.1.2.3")})
+		update.RemoveRRset([]dns.RR{mustRR(t, "pr-1234.ci.example.com. 0 IN TXT \"\"")})
+		update.RemoveName([]dns.RR{mustRR(t, "docs.ci.example.com. 0 IN A 0.0.0.0")})
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	records, _ = handler.ResolveRRs(dns.Question{Name: "pr-1234.ci.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, []string{"pr-1234.ci.example.com.\t60\tIN\tA\t10.1.2.4"}, recordStrings(records))
+	records, rcode = handler.ResolveRRs(dns.Question{Name: "pr-1234.ci.example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Empty(t, records)
+	_, rcode = handler.ResolveRRs(dns.Question{Name: "docs.ci.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeNameError, rcode)
+}
+
+func TestServesDynamicNamesAheadOfIPs(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestUpdateHandler("example.com.")
+	tcpAddr := startTestServers(t, handler, Listener{Net: "tcp", Addr: "127.0.0.1:0", Sockets: 1})
+	udpAddr := startTestServers(t, handler, Listener{Net: "udp", Addr: "127.0.0.1:0", UDPSize: dns.MaxMsgSize, Sockets: 1, FastPath: true})
+
+	rcode := sendUpdate(t, tcpAddr, func(update *dns.Msg) {
+		update.Insert([]dns.RR{mustRR(t, "10-0-0-1.example.com. 60 IN A 10.9.9.9")})
+	})
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	reply, err := dns.Exchange(new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA), udpAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10-0-0-1.example.com.\t60\tIN\tA\t10.9.9.9"}, recordStrings(reply.Answer))
+	reply, err = dns.Exchange(new(dns.Msg).SetQuestion("10-0-0-2.example.com.", dns.TypeA), udpAddr)
+	assert.NoError(t, err)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "10.0.0.2", reply.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestRefusesUnauthorizedUpdates(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestUpdateHandler("example.com.")
+	addr := startTestServers(t, handler, Listener{Net: "tcp", Addr: "127.0.0.1:0", Sockets: 1})
+
+	unsigned := new(dns.Msg).SetUpdate("example.com.")
+	unsigned.Insert([]dns.RR{mustRR(t, "pr-1.example.com. 60 IN A 10.1.2.3")})
+	reply, _, err := (&dns.Client{Net: "tcp"}).Exchange(unsigned, addr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	}
+
+	for _, record := range []string{
+		"www.example.com. 60 IN A 10.1.2.3",
+		"alpha.example.com. 60 IN A 10.1.2.3",
+		"example.com. 60 IN TXT \"apex\"",
+		"pr-1.example.com. 60 IN MX 10 mail.example.com.",
+	} {
+		rcode := sendUpdate(t, addr, func(update *dns.Msg) { update.Insert([]dns.RR{mustRR(t, record)}) })
+
+		assert.Equal(t, dns.RcodeRefused, rcode, record)
+	}
+
+	rcode := sendUpdate(t, addr, func(update *dns.Msg) {
+		update.Insert([]dns.RR{mustRR(t, "pr-1.example.net. 60 IN A 10.1.2.3")})
+	})
+
+	assert.Equal(t, dns.RcodeNotZone, rcode)
+	assert.Nil(t, handler.records.lookup("pr-1.example.com."))
+}
+
+func TestChecksUpdatePrerequisites(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler := newTestUpdateHandler("ci.example.com.")
+	addr := startTestServers(t, handler, Listener{Net: "tcp", Addr: "127.0.0.1:0", Sockets: 1})
+	create := func(update *dns.Msg) {
+		update.NameNotUsed([]dns.RR{mustRR(t, "pr-1.ci.example.com. 0 IN A 0.0.0.0")})
+		update.Insert([]dns.RR{mustRR(t, "pr-1.ci.example.com. 60 IN A 10.1.2.3")})
+	}
+
+	assert.Equal(t, dns.RcodeSuccess, sendUpdate(t, addr, create))
+	assert.Equal(t, dns.RcodeYXDomain, sendUpdate(t, addr, create))
+
+	// Value-dependent prerequisites compare whole record sets
+	assert.Equal(t, dns.RcodeNXRrset, sendUpdate(t, addr, func(update *dns.Msg) {
+		update.Used([]dns.RR{mustRR(t, "pr-1.ci.example.com. 0 IN A 10.1.2.4")})
+		update.Insert([]dns.RR{mustRR(t, "pr-1.ci.example.com. 60 IN A 10.1.2.5")})
+	}))
+	assert.Equal(t, dns.RcodeSuccess, sendUpdate(t, addr, func(update *dns.Msg) {
+		update.Used([]dns.RR{mustRR(t, "pr-1.ci.example.com. 0 IN A 10.1.2.3")})
+		update.RRsetNotUsed([]dns.RR{mustRR(t, "pr-1.ci.example.com. 0 IN TXT \"\"")})
+		update.Insert([]dns.RR{mustRR(t, "pr-1.ci.example.com. 60 IN A 10.1.2.5")})
+	}))
+	assert.Len(t, handler.records.lookup("pr-1.ci.example.com.")[dns.TypeA], 2)
+}
+
+func TestKeepsCNAMEsAlone(t *testing.T) {
+	sets := make(map[uint16][]dns.RR)
+
+	assert.Equal(t, []uint16{dns.TypeA}, applyUpdate(sets, mustRR(t, "pr-1.ci.example.com. 60 IN A 10.1.2.3")))
+	assert.Empty(t, applyUpdate(sets, mustRR(t, "pr-1.ci.example.com. 60 IN CNAME example.com.")))
+
+	sets = make(map[uint16][]dns.RR)
+
+	assert.Equal(t, []uint16{dns.TypeCNAME}, applyUpdate(sets, mustRR(t, "pr-1.ci.example.com. 60 IN CNAME example.com.")))
+	assert.Equal(t, []uint16{dns.TypeCNAME}, applyUpdate(sets, mustRR(t, "pr-1.ci.example.com. 60 IN CNAME www.example.com.")))
+	assert.Empty(t, applyUpdate(sets, mustRR(t, "pr-1.ci.example.com. 60 IN TXT \"text\"")))
+	assert.Equal(t, []string{"pr-1.ci.example.com.\t60\tIN\tCNAME\twww.example.com."}, recordStrings(sets[dns.TypeCNAME]))
+}
+
+func TestRejectsUpdatesWhenDisabled(t *testing.T) {
+	handler := newTestTransferHandler()
+	writer := &testResponseWriter{}
+
+	update := new(dns.Msg).SetUpdate("example.com.")
+	update.Insert([]dns.RR{mustRR(t, "pr-1.example.com. 60 IN A 10.1.2.3")})
+	handler.ServeDNS(writer, update)
+
+	assert.Equal(t, dns.RcodeNotImplemented, writer.messages[0].Rcode)
+}
+
+func TestRejectsUpdatesWithRecordStoreForAPIOnly(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	handler, _ := newTestAPIHandler()
+	handler.records.update([]recordChange{{
+		name:    "10-0-0-1.example.com.",
+		rrtype:  dns.TypeA,
+		records: []dns.RR{mustRR(t, "10-0-0-1.example.com. 60 IN A 6.6.6.6")},
+	}})
+	writer := &testResponseWriter{}
+
+	update := new(dns.Msg).SetUpdate("example.com.")
+	update.Insert([]dns.RR{mustRR(t, "10-0-0-1.example.com. 60 IN A 6.6.6.6")})
+	handler.ServeDNS(writer, update)
+
+	assert.Equal(t, dns.RcodeNotImplemented, writer.messages[0].Rcode)
+	// Without an update subtree, IP-derived names can't be overridden by stored records
+	records, _ := handler.ResolveRRs(dns.Question{Name: "10-0-0-1.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, []string{"10-0-0-1.example.com.\t86400\tIN\tA\t10.0.0.1"}, recordStrings(records))
+	wire, err := new(dns.Msg).SetQuestion("10-0-0-1.example.com.", dns.TypeA).Pack()
+	assert.NoError(t, err)
+	_, handled := newTestFastPathReader(handler).answer(wire, testFastPathClient)
+	assert.True(t, handled)
+}
+
+func recordStrings(records []dns.RR) []string {
+	strings := make([]string, len(records))
+	for i, record := range records {
+		strings[i] = record.String()
+	}
+	return strings
+}
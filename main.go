@@ -1,26 +1,67 @@
 package main
 
 import (
-	"log"
-
-	"github.com/Twixes/backname/internal/server"
-	"github.com/miekg/dns"
+	"flag"
+	"fmt"
+	"os"
 )
 
+const usage = `Usage: backname <command> [arguments]
+
+Commands:
+  serve                         Run the DNS server (default), configured with environment variables
+  encode <ip> [--zone <zone>]   Print every backname of the IP address, or its signed one with --secret
+  decode <name> [--zone <zone>] Print the IP address that the backname resolves to
+  check-config                  Validate the configuration from environment variables
+  query <name> [type]           Send a question to a running instance and print the reply
+  diagnose [--parent <server>]  Check the zone's delegation and glue at its parent against the configuration
+
+Run "backname <command> --help" for the command's flags.
+`
+
 func main() {
-	handler := new(server.DNSHandler)
-	handler.InitFromEnv()
-	server := &dns.Server{
-		Addr:      ":53",
-		Net:       "udp",
-		Handler:   handler,
-		UDPSize:   65535,
-		ReusePort: true,
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		return runServe(args)
 	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return runServe(args)
+	case "encode":
+		return runEncode(args)
+	case "decode":
+		return runDecode(args)
+	case "check-config":
+		return runCheckConfig(args)
+	case "query":
+		return runQuery(args)
+	case "diagnose":
+		return runDiagnose(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", command, usage)
+		return 2
+	}
+}
 
-	log.Printf("DNS server listening on %s\n", server.Addr)
-	err := server.ListenAndServe()
-	if err != nil {
-		log.Fatal(err)
+// Parse flags, allowing them to come after positional arguments, which are returned
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run the command, returning its exit code along with what it printed
+func runCaptured(t *testing.T, args ...string) (int, string, string) {
+	stdout, stderr := os.Stdout, os.Stderr
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout, os.Stderr = stdoutWriter, stderrWriter
+	capturedStdout, capturedStderr := make(chan string, 1), make(chan string, 1)
+	go func() { output, _ := io.ReadAll(stdoutReader); capturedStdout <- string(output) }()
+	go func() { output, _ := io.ReadAll(stderrReader); capturedStderr <- string(output) }()
+
+	exitCode := run(args)
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	return exitCode, <-capturedStdout, <-capturedStderr
+}
+
+func TestDispatchesSubcommands(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	setTestServeEnv(t)
+	t.Setenv("SIGNED_NAMES_SECRET", "")
+
+	exitCode, stdout, _ := runCaptured(t, "encode", "127.0.0.1")
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "127.0.0.1.example.com\n127-0-0-1.example.com\n", stdout)
+
+	exitCode, stdout, _ = runCaptured(t, "decode", "127-0-0-1.example.com")
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "127.0.0.1\n", stdout)
+
+	exitCode, stdout, _ = runCaptured(t, "check-config")
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "Configuration is valid\n", stdout)
+
+	exitCode, stdout, _ = runCaptured(t, "help")
+	assert.Equal(t, 0, exitCode)
+	assert.True(t, strings.HasPrefix(stdout, "Usage: backname <command>"))
+
+	exitCode, _, stderr := runCaptured(t, "resolve", "127-0-0-1.example.com")
+	assert.Equal(t, 2, exitCode)
+	assert.True(t, strings.HasPrefix(stderr, "Unknown command: resolve\n"))
+
+	// Missing arguments are usage errors
+	exitCode, _, stderr = runCaptured(t, "encode")
+	assert.Equal(t, 2, exitCode)
+	assert.True(t, strings.HasPrefix(stderr, "Usage: backname encode"))
+}
+
+func TestDispatchesQueryToRunningServer(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dnsAddr, _ := setTestServeEnv(t)
+	t.Setenv("HTTP_LISTEN", "")
+	t.Setenv("SHUTDOWN_TIMEOUT", "1s")
+	exitCode := startTestServe(t, dnsAddr)
+	defer shutdownTestServe(t, exitCode)
+
+	code, stdout, _ := runCaptured(t, "query", "10-0-0-1.example.com", "A", "--server", dnsAddr)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "10-0-0-1.example.com.\t86400\tIN\tA\t10.0.0.1")
+
+	code, stdout, _ = runCaptured(t, "query", "--tcp", "10-0-0-1.example.com", "--server", dnsAddr)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "10-0-0-1.example.com.\t86400\tIN\tA\t10.0.0.1")
+}
+
+func TestParsesFlagsAmongPositionalArguments(t *testing.T) {
+	for _, args := range [][]string{
+		{"127.0.0.1", "--zone", "example.com", "extra"},
+		{"--zone", "example.com", "127.0.0.1", "extra"},
+		{"127.0.0.1", "extra", "--zone=example.com"},
+	} {
+		flags := flag.NewFlagSet("encode", flag.ContinueOnError)
+		zone := flags.String("zone", "", "")
+		positional, err := parseInterspersed(flags, args)
+		assert.NoError(t, err, args)
+		assert.Equal(t, []string{"127.0.0.1", "extra"}, positional, args)
+		assert.Equal(t, "example.com", *zone, args)
+	}
+
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	_, err := parseInterspersed(flags, []string{"example.com", "--unknown"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,165 @@
+// Package backname converts between IP addresses and their backnames, i.e. domain names that resolve to them,
+// exactly the way the Backname server does.
+package backname
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Form is a way of writing an IP address into a domain name
+type Form int
+
+const (
+	// Dotted form, e.g. 127.0.0.1.<zone> or 2001.db8.0.0.0.0.0.1.<zone>
+	Dotted Form = iota
+	// Dashed form, e.g. 127-0-0-1.<zone> or 2001-db8--1.<zone>
+	Dashed
+)
+
+// Forms lists every supported form
+var Forms = []Form{Dotted, Dashed}
+
+var (
+	ErrInvalidIP     = errors.New("invalid IP address")
+	ErrInvalidForm   = errors.New("invalid backname form")
+	ErrAmbiguousName = errors.New("prefix makes the backname resolve to a different address")
+	ErrNotInZone     = errors.New("name is not within the zone")
+	ErrNotBackname   = errors.New("name does not contain an IP address")
+)
+
+func (f Form) String() string {
+	switch f {
+	case Dotted:
+		return "dotted"
+	case Dashed:
+		return "dashed"
+	}
+	return "Form(" + strconv.Itoa(int(f)) + ")"
+}
+
+// Encode returns the backname of the IP address in the given form within the zone, optionally preceded by prefix
+// labels (e.g. "foo" for foo.127-0-0-1.<zone>).
+func Encode(ip net.IP, zone string, form Form, prefix string) (string, error) {
+	var subdomain string
+	if ipv4 := ip.To4(); ipv4 != nil {
+		switch form {
+		case Dotted:
+			subdomain = ipv4.String()
+		case Dashed:
+			subdomain = strings.ReplaceAll(ipv4.String(), ".", "-")
+		default:
+			return "", ErrInvalidForm
+		}
+	} else if len(ip) == net.IPv6len {
+		switch form {
+		case Dotted:
+			groups := make([]string, 8)
+			for i := range groups {
+				groups[i] = strconv.FormatUint(uint64(ip[2*i])<<8|uint64(ip[2*i+1]), 16)
+			}
+			subdomain = strings.Join(groups, ".")
+		case Dashed:
+			subdomain = strings.ReplaceAll(ip.String(), ":", "-")
+			// Labels can't start or end with a hyphen, so spell out the leading or trailing zero group
+			if strings.HasPrefix(subdomain, "-") {
+				subdomain = "0" + subdomain
+			}
+			if strings.HasSuffix(subdomain, "-") {
+				subdomain += "0"
+			}
+		default:
+			return "", ErrInvalidForm
+		}
+	} else {
+		return "", ErrInvalidIP
+	}
+
+	if prefix = strings.Trim(prefix, "."); prefix != "" {
+		subdomain = prefix + "." + subdomain
+	}
+	if decoded := ParseSubdomain(strings.ToLower(subdomain)); !decoded.Equal(ip) {
+		return "", ErrAmbiguousName
+	}
+	if zone = strings.TrimSuffix(zone, "."); zone != "" {
+		return subdomain + "." + zone, nil
+	}
+	return subdomain, nil
+}
+
+// EncodeAll returns the backnames of the IP address in every supported form
+func EncodeAll(ip net.IP, zone string, prefix string) ([]string, error) {
+	names := make([]string, 0, len(Forms))
+	for _, form := range Forms {
+		name, err := Encode(ip, zone, form, prefix)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Decode returns the IP address that the name within the zone resolves to
+func Decode(name string, zone string) (net.IP, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	zone = strings.TrimSuffix(strings.ToLower(zone), ".")
+	if zone != "" {
+		if !strings.HasSuffix(name, "."+zone) {
+			return nil, ErrNotInZone
+		}
+		name = strings.TrimSuffix(name, "."+zone)
+	}
+	if ip := ParseSubdomain(name); ip != nil {
+		return ip, nil
+	}
+	return nil, ErrNotBackname
+}
+
+// ParseSubdomain returns the IP address that the lowercase subdomain (relative to the zone) resolves to, or nil if
+// there's none. IPv6 takes precedence over IPv4.
+func ParseSubdomain(subdomain string) net.IP {
+	if ipv6 := ParseIPv6Subdomain(subdomain); ipv6 != nil {
+		return ipv6
+	}
+	return ParseIPv4Subdomain(subdomain)
+}
+
+// ParseIPv4Subdomain returns the IPv4 address from the last label of the lowercase subdomain if it's dashed, or from
+// the last four labels otherwise, or nil if there's none
+func ParseIPv4Subdomain(subdomain string) net.IP {
+	subdomainParts := strings.Split(subdomain, ".")
+	var possibleIPv4 string
+	if strings.Contains(subdomainParts[len(subdomainParts)-1], "-") {
+		possibleIPv4 = strings.ReplaceAll(subdomainParts[len(subdomainParts)-1], "-", ".")
+	} else {
+		if len(subdomainParts) < 4 {
+			return nil
+		}
+		possibleIPv4 = strings.Join(subdomainParts[len(subdomainParts)-4:], ".")
+	}
+	address := net.ParseIP(possibleIPv4)
+	if address.To4() == nil { // Ensure not IPv6 address
+		return nil
+	}
+	return address
+}
+
+// ParseIPv6Subdomain returns the IPv6 address from the last label of the lowercase subdomain if it's dashed, or from
+// the last eight labels otherwise, or nil if there's none
+func ParseIPv6Subdomain(subdomain string) net.IP {
+	subdomainParts := strings.Split(subdomain, ".")
+	var possibleIPv6 string
+	if strings.Contains(subdomainParts[len(subdomainParts)-1], "-") {
+		possibleIPv6 = strings.ReplaceAll(subdomainParts[len(subdomainParts)-1], "-", ":")
+	} else {
+		if len(subdomainParts) < 8 {
+			return nil
+		}
+		possibleIPv6 = strings.Join(subdomainParts[len(subdomainParts)-8:], ":")
+	}
+	address := net.ParseIP(possibleIPv6)
+	return address
+}
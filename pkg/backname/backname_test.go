@@ -0,0 +1,104 @@
+package backname
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodesIPv4(t *testing.T) {
+	names, err := EncodeAll(net.ParseIP("127.0.0.1"), "example.com", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1.example.com", "127-0-0-1.example.com"}, names)
+}
+
+func TestEncodesIPv6(t *testing.T) {
+	names, err := EncodeAll(net.ParseIP("2a00:1450:401b:810::200e"), "example.com.", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2a00.1450.401b.810.0.0.0.200e.example.com", "2a00-1450-401b-810--200e.example.com"}, names)
+
+	name, err := Encode(net.ParseIP("::1"), "example.com", Dashed, "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "0--1.example.com", name)
+
+	name, err = Encode(net.ParseIP("2001:db8::"), "example.com", Dashed, "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2001-db8--0.example.com", name)
+}
+
+func TestEncodesWithPrefix(t *testing.T) {
+	name, err := Encode(net.ParseIP("10.0.0.1"), "example.com", Dashed, "foo.bar")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "foo.bar.10-0-0-1.example.com", name)
+}
+
+func TestRefusesToEncodeAmbiguousNames(t *testing.T) {
+	// The four prefix labels would make the last eight labels a valid IPv6 address
+	_, err := Encode(net.ParseIP("10.0.0.1"), "example.com", Dotted, "a.b.c.d")
+
+	assert.ErrorIs(t, err, ErrAmbiguousName)
+
+	_, err = Encode(net.ParseIP("10.0.0.1"), "example.com", Dotted, "foo")
+
+	assert.NoError(t, err)
+}
+
+func TestRefusesToEncodeInvalidIP(t *testing.T) {
+	_, err := Encode(net.IP{1, 2, 3}, "example.com", Dotted, "")
+
+	assert.ErrorIs(t, err, ErrInvalidIP)
+
+	_, err = Encode(net.ParseIP("10.0.0.1"), "example.com", Form(7), "")
+
+	assert.ErrorIs(t, err, ErrInvalidForm)
+}
+
+func TestDecodes(t *testing.T) {
+	for name, expected := range map[string]string{
+		"142.250.147.138.example.com":               "142.250.147.138",
+		"127-0-0-1.example.com.":                    "127.0.0.1",
+		"FOO.127-0-0-1.Example.COM":                 "127.0.0.1",
+		"2a00.1450.401b.810.0.0.0.200e.example.com": "2a00:1450:401b:810::200e",
+		"0--1.example.com":                          "::1",
+	} {
+		ip, err := Decode(name, "example.com.")
+
+		assert.NoError(t, err, name)
+		assert.Equal(t, net.ParseIP(expected), ip, name)
+	}
+}
+
+func TestDoesNotDecodeOtherNames(t *testing.T) {
+	_, err := Decode("127-0-0-1.example.org", "example.com")
+
+	assert.ErrorIs(t, err, ErrNotInZone)
+
+	_, err = Decode("www.example.com", "example.com")
+
+	assert.ErrorIs(t, err, ErrNotBackname)
+
+	_, err = Decode("256-0-0-1.example.com", "example.com")
+
+	assert.ErrorIs(t, err, ErrNotBackname)
+}
+
+func TestRoundTrips(t *testing.T) {
+	for _, raw := range []string{"0.0.0.0", "255.255.255.255", "::", "::1", "fe80::1", "2001:db8:1:2:3:4:5:6", "1::"} {
+		ip := net.ParseIP(raw)
+		names, err := EncodeAll(ip, "example.com", "x")
+
+		assert.NoError(t, err, raw)
+		for _, name := range names {
+			decoded, err := Decode(name, "example.com")
+
+			assert.NoError(t, err, name)
+			assert.True(t, ip.Equal(decoded), name)
+		}
+	}
+}
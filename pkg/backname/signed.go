@@ -0,0 +1,99 @@
+package backname
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureLength is the number of characters of the signature that starts the label of a signed backname
+const SignatureLength = 10
+
+// MinSecretLength is the number of bytes of the shortest secret to sign backnames with, so that signatures can't be
+// guessed from a few names
+const MinSecretLength = 16
+
+var ErrInvalidSignature = errors.New("backname is not signed with the secret, or has expired")
+
+var signatureEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// EncodeSigned returns the signed backname of the IP address within the zone, optionally preceded by prefix labels:
+// its dashed form, preceded by a signature of the address and expiry made with the secret, and the expiry itself if
+// not zero, e.g. k3f9a2p7qx-127-0-0-1.<zone>. With signed names required, only those resolve until they expire.
+func EncodeSigned(ip net.IP, zone string, secret []byte, expires time.Time, prefix string) (string, error) {
+	dashed, err := Encode(ip, "", Dashed, "")
+	if err != nil {
+		return "", err
+	}
+	var expiry int64
+	if !expires.IsZero() {
+		expiry = expires.Unix()
+	}
+	label := sign(ip, expiry, secret)
+	if expiry != 0 {
+		label += strconv.FormatInt(expiry, 36)
+	}
+	subdomain := label + "-" + dashed
+
+	if prefix = strings.Trim(prefix, "."); prefix != "" {
+		subdomain = prefix + "." + subdomain
+	}
+	if zone = strings.TrimSuffix(zone, "."); zone != "" {
+		return subdomain + "." + zone, nil
+	}
+	return subdomain, nil
+}
+
+// DecodeSigned returns the IP address that the signed name within the zone resolves to at the given time
+func DecodeSigned(name string, zone string, secret []byte, now time.Time) (net.IP, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	zone = strings.TrimSuffix(strings.ToLower(zone), ".")
+	if zone != "" {
+		if !strings.HasSuffix(name, "."+zone) {
+			return nil, ErrNotInZone
+		}
+		name = strings.TrimSuffix(name, "."+zone)
+	}
+	if ip, _ := ParseSignedSubdomain(name, secret, now); ip != nil {
+		return ip, nil
+	}
+	return nil, ErrInvalidSignature
+}
+
+// ParseSignedSubdomain returns the IP address from the last label of the lowercase subdomain if it's signed with the
+// secret and not expired at the given time, or nil if there's none, along with when the name expires, zero if never
+func ParseSignedSubdomain(subdomain string, secret []byte, now time.Time) (net.IP, time.Time) {
+	label := subdomain[strings.LastIndexByte(subdomain, '.')+1:]
+	head, dashed, ok := strings.Cut(label, "-")
+	if !ok || len(head) < SignatureLength || !strings.Contains(dashed, "-") {
+		return nil, time.Time{}
+	}
+	var expiry int64
+	var expires time.Time
+	if expiryRaw := head[SignatureLength:]; expiryRaw != "" {
+		var err error
+		if expiry, err = strconv.ParseInt(expiryRaw, 36, 64); err != nil || expiry <= 0 || now.Unix() >= expiry {
+			return nil, time.Time{}
+		}
+		expires = time.Unix(expiry, 0)
+	}
+	ip := ParseSubdomain(dashed)
+	if ip == nil || !hmac.Equal([]byte(head[:SignatureLength]), []byte(sign(ip, expiry, secret))) {
+		return nil, time.Time{}
+	}
+	return ip, expires
+}
+
+// Compute the signature of the IP address and expiry, as Unix time or zero for none
+func sign(ip net.IP, expiry int64, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(ip.To16())
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(expiry)))
+	return signatureEncoding.EncodeToString(mac.Sum(nil))[:SignatureLength]
+}
@@ -0,0 +1,66 @@
+package backname
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSecret = []byte("0123456789abcdef")
+
+func TestEncodesSigned(t *testing.T) {
+	name, err := EncodeSigned(net.ParseIP("10.0.0.1"), "example.com", testSecret, time.Time{}, "")
+
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[a-z2-7]{10}-10-0-0-1\.example\.com$`, name)
+
+	expiring, err := EncodeSigned(net.ParseIP("10.0.0.1"), "example.com", testSecret, time.Unix(2000000000, 0), "foo")
+
+	assert.NoError(t, err)
+	assert.Regexp(t, `^foo\.[a-z2-7]{10}x2qxvk-10-0-0-1\.example\.com$`, expiring)
+	// The expiry is part of what's signed
+	assert.NotEqual(t, name[:SignatureLength], strings.TrimPrefix(expiring, "foo.")[:SignatureLength])
+}
+
+func TestDecodesSigned(t *testing.T) {
+	now := time.Unix(1900000000, 0)
+	for _, raw := range []string{"10.0.0.1", "::1", "2001:db8:1:2:3:4:5:6"} {
+		ip := net.ParseIP(raw)
+		for _, expires := range []time.Time{{}, now.Add(time.Hour)} {
+			name, err := EncodeSigned(ip, "example.com", testSecret, expires, "")
+			assert.NoError(t, err, raw)
+
+			decoded, err := DecodeSigned(strings.ToUpper(name), "example.com.", testSecret, now)
+
+			assert.NoError(t, err, name)
+			assert.True(t, ip.Equal(decoded), name)
+		}
+	}
+}
+
+func TestRejectsInvalidSignatures(t *testing.T) {
+	now := time.Unix(1900000000, 0)
+	name, _ := EncodeSigned(net.ParseIP("10.0.0.1"), "example.com", testSecret, time.Time{}, "")
+	expired, _ := EncodeSigned(net.ParseIP("10.0.0.1"), "example.com", testSecret, now.Add(-time.Second), "")
+
+	for _, invalid := range []string{
+		// Another address with the same signature
+		strings.Replace(name, "10-0-0-1", "10-0-0-2", 1),
+		// Another expiry with the same signature
+		strings.Replace(expired, "-10", "z-10", 1),
+		expired,
+		"10-0-0-1.example.com",
+		"aaaaaaaaaa-10-0-0-1.example.com",
+	} {
+		_, err := DecodeSigned(invalid, "example.com", testSecret, now)
+
+		assert.ErrorIs(t, err, ErrInvalidSignature, invalid)
+	}
+
+	_, err := DecodeSigned(name, "example.com", []byte("another secret!!"), now)
+
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
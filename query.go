@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func runQuery(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	serverAddr := flags.String("server", "127.0.0.1:53", "address of the Backname instance")
+	overTCP := flags.Bool("tcp", false, "query over TCP instead of UDP")
+	timeout := flags.Duration("timeout", 2*time.Second, "how long to wait for the reply")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: backname query <name> [type] [--server <address>] [--tcp]")
+		return 2
+	}
+
+	qtype := dns.TypeA
+	if len(positional) == 2 {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(positional[1])]; !ok {
+			fmt.Fprintf(os.Stderr, "Unknown record type: %s\n", positional[1])
+			return 1
+		}
+	}
+
+	client := &dns.Client{Net: "udp", Timeout: *timeout}
+	if *overTCP {
+		client.Net = "tcp"
+	}
+	query := new(dns.Msg).SetQuestion(dns.Fqdn(positional[0]), qtype)
+	query.SetEdns0(1232, false)
+	reply, rtt, err := client.Exchange(query, *serverAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Query to %s failed: %v\n", *serverAddr, err)
+		return 1
+	}
+
+	fmt.Println(reply)
+	fmt.Printf(";; Query time: %v\n;; Server: %s (%s)\n", rtt.Round(time.Microsecond), *serverAddr, client.Net)
+	return 0
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Twixes/backname/internal/server"
+	"github.com/miekg/dns"
+)
+
+// How long in-flight requests get to finish on shutdown, unless SHUTDOWN_TIMEOUT says otherwise
+const defaultShutdownTimeout = 5 * time.Second
+
+func runServe(args []string) (exitCode int) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Parse(args)
+
+	shutdownTimeout := shutdownTimeoutFromEnv()
+	httpListen := httpListenFromEnv()
+
+	handler := new(server.DNSHandler)
+	handler.InitFromEnv()
+	listeners := server.ListenersFromEnv()
+	// Whichever way serving ends, including a store that failed to open after another one did
+	defer func() {
+		if err := handler.Close(); err != nil {
+			log.Printf("DNS handler did not close cleanly: %v\n", err)
+			exitCode = 1
+		}
+	}()
+	if err := handler.OpenStores(); err != nil {
+		log.Printf("Failed to open stores: %v\n", err)
+		return 1
+	}
+	readiness := server.NewReadiness(handler)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	serveErrors := make(chan error, 1)
+	// The HTTP server starts first, so that the process reports being alive while the DNS listeners come up
+	var httpServer *http.Server
+	if httpListen != "" {
+		httpListener, err := net.Listen("tcp", httpListen)
+		if err != nil {
+			log.Printf("HTTP server failed to listen on %s: %v\n", httpListen, err)
+			return 1
+		}
+		mux := server.NewHTTPHandler(readiness)
+		handler.RegisterAPI(mux)
+		httpServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := httpServer.Serve(httpListener); err != http.ErrServerClosed {
+				select {
+				case serveErrors <- fmt.Errorf("HTTP server: %w", err):
+				default:
+				}
+			}
+		}()
+		log.Printf("HTTP server listening on %s\n", httpListener.Addr())
+	}
+
+	var servers []*dns.Server
+	for _, listener := range listeners {
+		listenerServers, err := listener.Servers(handler)
+		if err != nil {
+			log.Printf("DNS server failed to listen on %s: %v\n", listener, err)
+			shutdownAll(servers, httpServer, shutdownTimeout)
+			return 1
+		}
+		for _, server := range listenerServers {
+			servers = append(servers, server)
+			go func() {
+				if err := server.ActivateAndServe(); err != nil {
+					select {
+					case serveErrors <- fmt.Errorf("%s: %w", listener, err):
+					default:
+					}
+				}
+			}()
+		}
+		log.Printf("DNS server listening on %s (%d sockets)\n", listener, len(listenerServers))
+	}
+	readiness.SetListenersBound(true)
+	stopPruning := make(chan struct{})
+	defer close(stopPruning)
+	go handler.PruneBlocklistEvery(time.Minute, stopPruning)
+	go handler.DiagnoseDelegationFromEnv()
+	// Secondaries may have missed configuration changes while the process was down
+	handler.NotifySecondaries()
+
+	select {
+	case err := <-serveErrors:
+		log.Printf("Server failed: %v\n", err)
+		shutdownAll(servers, httpServer, shutdownTimeout)
+		return 1
+	case received := <-signals:
+		// A second signal terminates the process right away
+		signal.Stop(signals)
+		log.Printf("Received %s, shutting down (waiting up to %s for in-flight requests)\n", received, shutdownTimeout)
+	}
+
+	readiness.SetListenersBound(false)
+	if err := shutdownAll(servers, httpServer, shutdownTimeout); err != nil {
+		log.Printf("DNS server did not shut down cleanly: %v\n", err)
+		return 1
+	}
+	log.Println("DNS server shut down cleanly")
+	return 0
+}
+
+// Read how long in-flight requests get to finish on shutdown from the SHUTDOWN_TIMEOUT environment variable
+func shutdownTimeoutFromEnv() time.Duration {
+	shutdownTimeoutRaw := os.Getenv("SHUTDOWN_TIMEOUT")
+	if shutdownTimeoutRaw == "" {
+		return defaultShutdownTimeout
+	}
+	shutdownTimeout, err := time.ParseDuration(shutdownTimeoutRaw)
+	if err != nil || shutdownTimeout < 0 {
+		log.Fatalf("SHUTDOWN_TIMEOUT environment variable is invalid: %s", shutdownTimeoutRaw)
+	}
+	return shutdownTimeout
+}
+
+// Read the address to serve HTTP on from the HTTP_LISTEN environment variable, empty meaning no HTTP server
+func httpListenFromEnv() string {
+	httpListen := os.Getenv("HTTP_LISTEN")
+	if httpListen != "" {
+		if _, _, err := net.SplitHostPort(httpListen); err != nil {
+			log.Fatalf("HTTP_LISTEN environment variable is invalid: %s", httpListen)
+		}
+	}
+	return httpListen
+}
+
+// Stop all servers, including the HTTP one if any, from accepting requests, and wait for their in-flight requests to
+// finish within the timeout
+func shutdownAll(servers []*dns.Server, httpServer *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	shutdownErrors := make([]error, len(servers)+1)
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownErrors[i] = server.ShutdownContext(ctx)
+		}()
+	}
+	if httpServer != nil {
+		shutdownErrors[len(servers)] = httpServer.Shutdown(ctx)
+	}
+	wg.Wait()
+	return errors.Join(shutdownErrors...)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Configure a server with the HTTP API on loopback ports, returning the addresses of its DNS and HTTP listeners
+func setTestServeEnv(t *testing.T) (string, string) {
+	dnsAddr := freeLoopbackAddr(t)
+	httpAddr := freeLoopbackAddr(t)
+	t.Setenv("ZONE", "example.com")
+	t.Setenv("NAMESERVER_A", "127.0.0.1")
+	t.Setenv("LISTEN", "udp://"+dnsAddr+",tcp://"+dnsAddr)
+	t.Setenv("HTTP_LISTEN", httpAddr)
+	t.Setenv("API_TOKENS", "ci-token:5")
+	t.Setenv("RECORD_STORE", filepath.Join(t.TempDir(), "records.log"))
+	return dnsAddr, httpAddr
+}
+
+// Address on loopback with a port that's free both over UDP and TCP
+func freeLoopbackAddr(t *testing.T) string {
+	for range 10 {
+		packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := packetConn.LocalAddr().String()
+		listener, err := net.Listen("tcp", addr)
+		packetConn.Close()
+		if err == nil {
+			listener.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free port on loopback")
+	return ""
+}
+
+// Run the server in the background, returning its exit code once it's done
+func startTestServe(t *testing.T, dnsAddr string) <-chan int {
+	exitCode := make(chan int, 1)
+	go func() { exitCode <- run([]string{"serve"}) }()
+	// Signals are only handled by the server once it answers
+	client := &dns.Client{Timeout: 100 * time.Millisecond}
+	query := new(dns.Msg).SetQuestion("127-0-0-1.example.com.", dns.TypeA)
+	for range 50 {
+		response, _, err := client.Exchange(query, dnsAddr)
+		if err == nil {
+			assert.Equal(t, []string{"127-0-0-1.example.com.\t86400\tIN\tA\t127.0.0.1"}, answerStrings(response))
+			return exitCode
+		}
+		select {
+		case code := <-exitCode:
+			t.Fatalf("server exited with %d before answering", code)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("server never answered")
+	return nil
+}
+
+// Stop the server with a signal, expecting it to exit cleanly
+func shutdownTestServe(t *testing.T, exitCode <-chan int) {
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case code := <-exitCode:
+		assert.Equal(t, 0, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not exit")
+	}
+}
+
+func answerStrings(msg *dns.Msg) []string {
+	var answers []string
+	for _, rr := range msg.Answer {
+		answers = append(answers, rr.String())
+	}
+	return answers
+}
+
+// Send a request to create an alias, holding back the end of its body so that it stays in flight until the returned
+// function sends it and reads the response
+func startAliasRequest(t *testing.T, httpAddr string) func() (*http.Response, error) {
+	conn, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	body := `{"name":"demo","ip":"10.0.0.7"}`
+	fmt.Fprintf(conn, "POST /v1/names HTTP/1.1\r\nHost: %s\r\nAuthorization: Bearer ci-token\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", httpAddr, len(body), body[:10])
+	return func() (*http.Response, error) {
+		if _, err := io.WriteString(conn, body[10:]); err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+}
+
+func TestServeDrainsInFlightRequestsOnSignal(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dnsAddr, httpAddr := setTestServeEnv(t)
+	exitCode := startTestServe(t, dnsAddr)
+	finishRequest := startAliasRequest(t, httpAddr)
+	// Until the server has read the start of the request, it wouldn't count as in flight
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+
+	select {
+	case code := <-exitCode:
+		t.Fatalf("server exited with %d before the request in flight finished", code)
+	case <-time.After(200 * time.Millisecond):
+	}
+	response, err := finishRequest()
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		response.Body.Close()
+	}
+	select {
+	case code := <-exitCode:
+		assert.Equal(t, 0, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not exit")
+	}
+	// The alias was stored before the store was closed
+	records, err := os.ReadFile(os.Getenv("RECORD_STORE"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(records), "demo.example.com.")
+}
+
+func TestServeFailsWhenInFlightRequestsOutlastShutdownTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	dnsAddr, httpAddr := setTestServeEnv(t)
+	t.Setenv("SHUTDOWN_TIMEOUT", "100ms")
+	exitCode := startTestServe(t, dnsAddr)
+	startAliasRequest(t, httpAddr)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGINT))
+
+	select {
+	case code := <-exitCode:
+		assert.Equal(t, 1, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not exit")
+	}
+}
+
+func TestServeFailsWhenListenerCannotBind(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	setTestServeEnv(t)
+	// Bound without SO_REUSEPORT, so that the server can't share the port
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	t.Setenv("LISTEN", "udp://"+packetConn.LocalAddr().String())
+
+	assert.Equal(t, 1, run([]string{"serve"}))
+}
+
+func TestServeFailsWhenRecordStoreIsCorrupted(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	setTestServeEnv(t)
+	if err := os.WriteFile(os.Getenv("RECORD_STORE"), []byte("not json\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, runServe(nil))
+}